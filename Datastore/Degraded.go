@@ -0,0 +1,351 @@
+package Datastore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/capability"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/delay"
+)
+
+// Degraded mode handling for periods when datastore is read-only (scheduled maintenance)
+// or memcache is unavailable. The plain PutInDatastore* helpers fail fast with
+// ErrServiceUnavailable while datastore can't be written to; writes made through the
+// *OrQueue helpers are turned into task queue tasks instead and replayed once it can.
+//
+// Every write made through the *OrQueue helpers stamps a version on the entity, kept in a
+// WriteVersionKind child entity. A replayed write is skipped if the entity has been
+// written with a newer version since it was queued, so a stale replay doesn't overwrite
+// what was stored after datastore recovered. Writes made with the plain helpers aren't
+// versioned - use the *OrQueue helpers for all the writes of entities that can be queued.
+
+// How long a service status is trusted before the capabilities are checked again
+var ServiceStatusCacheDuration = 10 * time.Second
+
+type ServiceStatus struct {
+	DatastoreRead  bool
+	DatastoreWrite bool
+	Memcache       bool
+	//Writes queued by this instance since it started. Replays run on any instance, so
+	//this is neither a global count nor the number of writes still waiting.
+	InstanceQueuedWrites int64
+	CheckedAt            time.Time
+}
+
+func (s ServiceStatus) IsDegraded() bool {
+	return !s.DatastoreRead || !s.DatastoreWrite || !s.Memcache
+}
+
+var serviceStatus struct {
+	sync.Mutex
+	status ServiceStatus
+}
+
+// Number of writes queued by this instance
+var queuedWrites int64
+
+// Kind of the entities holding the versions of the entities written by the *OrQueue helpers
+const WriteVersionKind = "DatastoreWriteVersion"
+
+type writeVersion struct {
+	Version int64
+}
+
+// Checks the capabilities, replaced in tests
+var capabilityEnabled = capability.Enabled
+
+func init() {
+	//Types of the property values that are gob encoded as interfaces
+	gob.Register(time.Time{})
+	gob.Register(appengine.GeoPoint{})
+	gob.Register(datastore.ByteString{})
+}
+
+// Returns the current availability of datastore and memcache, checking the capabilities
+// at most once every ServiceStatusCacheDuration
+func GetServiceStatus(c context.Context) ServiceStatus {
+	serviceStatus.Lock()
+	status := serviceStatus.status
+	serviceStatus.Unlock()
+	if time.Since(status.CheckedAt) < ServiceStatusCacheDuration {
+		status.InstanceQueuedWrites = atomic.LoadInt64(&queuedWrites)
+		return status
+	}
+	return RefreshServiceStatus(c)
+}
+
+// Checks the capabilities regardless of the cached status
+func RefreshServiceStatus(c context.Context) ServiceStatus {
+	status := ServiceStatus{
+		DatastoreRead:  capabilityEnabled(c, "datastore_v3", "*"),
+		DatastoreWrite: capabilityEnabled(c, "datastore_v3", "write"),
+		Memcache:       capabilityEnabled(c, "memcache", "*"),
+		CheckedAt:      time.Now(),
+	}
+	status.DatastoreWrite = status.DatastoreWrite && status.DatastoreRead
+
+	serviceStatus.Lock()
+	previous := serviceStatus.status
+	serviceStatus.status = status
+	serviceStatus.Unlock()
+
+	if status.IsDegraded() && !previous.IsDegraded() {
+		Log.Warningf(c, "RefreshServiceStatus - entering degraded mode - %+v", status)
+	}
+	if !status.IsDegraded() && previous.IsDegraded() {
+		Log.Infof(c, "RefreshServiceStatus - leaving degraded mode")
+	}
+	status.InstanceQueuedWrites = atomic.LoadInt64(&queuedWrites)
+	return status
+}
+
+func IsDatastoreWritable(c context.Context) bool {
+	return GetServiceStatus(c).DatastoreWrite
+}
+
+// Records that a call failed because datastore writes are unavailable, so that following
+// writes are queued without waiting for the next capability check
+func markDatastoreWriteUnavailable() {
+	serviceStatus.Lock()
+	serviceStatus.status.DatastoreWrite = false
+	serviceStatus.status.CheckedAt = time.Now()
+	serviceStatus.Unlock()
+}
+
+// Marks datastore writes unavailable if err says they are disabled
+func noteWriteError(err error) {
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "capability_disabled") {
+		markDatastoreWriteUnavailable()
+	}
+}
+
+// A property of a queued write. Keys and nested entities don't survive gob encoding, so
+// keys are stored encoded and entities as their own properties.
+type queuedProperty struct {
+	Name     string
+	Value    interface{}
+	Key      string
+	Entity   *queuedEntity
+	NoIndex  bool
+	Multiple bool
+}
+
+type queuedEntity struct {
+	Key        string
+	Properties []queuedProperty
+}
+
+// A write waiting for datastore to be writable again
+type queuedWrite struct {
+	Key        string
+	Version    int64
+	Properties []queuedProperty
+}
+
+func encodeKey(key *datastore.Key) string {
+	if key == nil {
+		return ""
+	}
+	return key.Encode()
+}
+
+func decodeKey(encoded string) (*datastore.Key, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	return datastore.DecodeKey(encoded)
+}
+
+func encodeProperties(props []datastore.Property) []queuedProperty {
+	answer := make([]queuedProperty, len(props))
+	for i, p := range props {
+		answer[i] = queuedProperty{Name: p.Name, NoIndex: p.NoIndex, Multiple: p.Multiple}
+		switch v := p.Value.(type) {
+		case *datastore.Key:
+			answer[i].Key = encodeKey(v)
+		case *datastore.Entity:
+			answer[i].Entity = &queuedEntity{Key: encodeKey(v.Key), Properties: encodeProperties(v.Properties)}
+		default:
+			answer[i].Value = v
+		}
+	}
+	return answer
+}
+
+func decodeProperties(props []queuedProperty) (datastore.PropertyList, error) {
+	answer := make(datastore.PropertyList, len(props))
+	for i, p := range props {
+		answer[i] = datastore.Property{Name: p.Name, Value: p.Value, NoIndex: p.NoIndex, Multiple: p.Multiple}
+		switch {
+		case p.Key != "":
+			key, err := decodeKey(p.Key)
+			if err != nil {
+				return nil, err
+			}
+			answer[i].Value = key
+		case p.Entity != nil:
+			key, err := decodeKey(p.Entity.Key)
+			if err != nil {
+				return nil, err
+			}
+			nested, err := decodeProperties(p.Entity.Properties)
+			if err != nil {
+				return nil, err
+			}
+			answer[i].Value = &datastore.Entity{Key: key, Properties: nested}
+		}
+	}
+	return answer, nil
+}
+
+// Returns the key of the entity holding the version of the entity with the given key.
+// It is in the same entity group, so both can be written in one transaction.
+func writeVersionKey(c context.Context, key *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, WriteVersionKind, "version", 0, key)
+}
+
+// Returns a version for a write made now
+func newWriteVersion() int64 {
+	return time.Now().UnixNano()
+}
+
+var replayWrite = delay.MustRegister("Datastore.replayWrite", func(c context.Context, w queuedWrite) error {
+	key, err := datastore.DecodeKey(w.Key)
+	if err != nil {
+		//Retrying won't help
+		Log.Errorf(c, "replayWrite - %v", err)
+		return nil
+	}
+	if !capabilityEnabled(c, "datastore_v3", "write") {
+		//Returning an error makes the task queue retry later
+		return newError("replayWrite", key.Kind(), key.StringID(), ErrServiceUnavailable)
+	}
+	props, err := decodeProperties(w.Properties)
+	if err != nil {
+		Log.Errorf(c, "replayWrite - %v", err)
+		return nil
+	}
+	err = datastore.RunInTransaction(c, func(tc context.Context) error {
+		versionKey := writeVersionKey(tc, key)
+		stored := new(writeVersion)
+		err := datastore.Get(tc, versionKey, stored)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if stored.Version >= w.Version {
+			Log.Infof(c, "replayWrite - %v written again since it was queued, skipping", key)
+			return nil
+		}
+		_, err = datastore.PutMulti(tc, []*datastore.Key{key, versionKey}, []interface{}{&props, &writeVersion{Version: w.Version}})
+		return err
+	}, nil)
+	if err != nil {
+		Log.Errorf(c, "replayWrite - %v", err)
+		return wrapError("replayWrite", key.Kind(), key.StringID(), err)
+	}
+	return nil
+})
+
+// Queues a write to be replayed once datastore is writable again
+func QueueDatastoreWrite(c context.Context, kind, stringID string, variable interface{}) error {
+	var props datastore.PropertyList
+	var err error
+	if pls, ok := variable.(datastore.PropertyLoadSaver); ok {
+		props, err = pls.Save()
+	} else {
+		props, err = datastore.SaveStruct(variable)
+	}
+	if err != nil {
+		return &OpError{Op: "QueueDatastoreWrite", Kind: kind, Key: stringID, Err: ErrEncode, Cause: err}
+	}
+	w := queuedWrite{
+		Key:        datastore.NewKey(c, kind, stringID, 0, nil).Encode(),
+		Version:    newWriteVersion(),
+		Properties: encodeProperties(props),
+	}
+	if err := replayWrite.Call(c, w); err != nil {
+		Log.Errorf(c, "QueueDatastoreWrite - %v", err)
+		return wrapError("QueueDatastoreWrite", kind, stringID, err)
+	}
+	atomic.AddInt64(&queuedWrites, 1)
+	return nil
+}
+
+// Puts the variable and its new version
+func putVersioned(c context.Context, kind, stringID string, variable interface{}) (*datastore.Key, error) {
+	if !IsDatastoreWritable(c) {
+		return nil, newError("PutInDatastoreSimpleOrQueue", kind, stringID, ErrServiceUnavailable)
+	}
+	key := datastore.NewKey(c, kind, stringID, 0, nil)
+	keys := []*datastore.Key{key, writeVersionKey(c, key)}
+	_, err := datastore.PutMulti(c, keys, []interface{}{variable, &writeVersion{Version: newWriteVersion()}})
+	noteWriteError(err)
+	if multi, ok := err.(appengine.MultiError); ok {
+		err = errors.Join(multi...)
+	}
+	return key, wrapError("PutInDatastoreSimpleOrQueue", kind, stringID, err)
+}
+
+// Puts the variable in datastore, or queues the write for replay if datastore is read-only.
+// queued reports whether the write was deferred.
+func PutInDatastoreSimpleOrQueue(c context.Context, kind, stringID string, variable interface{}) (key *datastore.Key, queued bool, err error) {
+	if stringID != "" {
+		key, err = putVersioned(c, kind, stringID, variable)
+	} else {
+		key, err = PutInDatastoreSimple(c, kind, stringID, variable)
+	}
+	if err == nil || !errors.Is(err, ErrServiceUnavailable) {
+		return key, false, err
+	}
+	Log.Warningf(c, "PutInDatastoreSimpleOrQueue - %v", err)
+	if stringID == "" {
+		//Without a stable ID a replayed write could be stored twice
+		return nil, false, newError("PutInDatastoreSimpleOrQueue", kind, stringID, ErrServiceUnavailable)
+	}
+	if err = QueueDatastoreWrite(c, kind, stringID, variable); err != nil {
+		return nil, false, err
+	}
+	return datastore.NewKey(c, kind, stringID, 0, nil), true, nil
+}
+
+// Like PutInDatastoreSimpleOrQueue, but also stores the variable in memcache so that
+// GetFromDatastoreSimpleOrMemcache returns the new value while the write is queued
+func PutInDatastoreSimpleAndMemcacheOrQueue(c context.Context, kind, stringID, memcacheID string, variable interface{}) (*datastore.Key, bool, error) {
+	key, queued, err := PutInDatastoreSimpleOrQueue(c, kind, stringID, variable)
+	if err != nil {
+		return nil, false, err
+	}
+	if GetServiceStatus(c).Memcache {
+		PutInMemcache(c, memcacheID, variable)
+	}
+	return key, queued, nil
+}
+
+// HTTP handler reporting the ServiceStatus as JSON. Responds with 503 while degraded.
+// Mount it on a mux, for example web.Mux.HandleFunc("/_status", Datastore.ServiceStatusHandler).
+func ServiceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	status := RefreshServiceStatus(c)
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	if status.IsDegraded() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		Log.Errorf(c, "ServiceStatusHandler - %v", err)
+	}
+}
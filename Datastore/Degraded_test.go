@@ -0,0 +1,136 @@
+package Datastore_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/protobuf/runtime/protoiface"
+
+	. "github.com/ThePiachu/Go/Datastore"
+)
+
+func TestQueuedWriteEncoding(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test")
+	c := context.Background()
+	parent := datastore.NewKey(c, "Parent", "p", 0, nil)
+	key := datastore.NewKey(c, "Kind", "id", 0, parent)
+	ref := datastore.NewKey(c, "Other", "", 42, nil)
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	props := datastore.PropertyList{
+		{Name: "Name", Value: "name"},
+		{Name: "Count", Value: int64(3), NoIndex: true},
+		{Name: "Time", Value: now},
+		{Name: "Ref", Value: ref},
+		{Name: "Refs", Value: ref, Multiple: true},
+		{Name: "Nested", Value: &datastore.Entity{Key: ref, Properties: []datastore.Property{{Name: "Ref", Value: parent}}}},
+		{Name: "Point", Value: appengine.GeoPoint{Lat: 1, Lng: 2}},
+		{Name: "Bytes", Value: datastore.ByteString("abc")},
+	}
+	decodedKey, decoded, err := RoundTripQueuedWrite(key, props)
+	if err != nil {
+		t.Fatalf("RoundTripQueuedWrite - %v", err)
+	}
+	if !decodedKey.Equal(key) {
+		t.Errorf("Key changed - %v", decodedKey)
+	}
+	if len(decoded) != len(props) {
+		t.Fatalf("Properties lost - %v", decoded)
+	}
+	for i, p := range decoded {
+		if k, ok := p.Value.(*datastore.Key); ok {
+			if !k.Equal(ref) || p.Multiple != props[i].Multiple {
+				t.Errorf("Key property changed - %v", p)
+			}
+			continue
+		}
+		if e, ok := p.Value.(*datastore.Entity); ok {
+			if !e.Key.Equal(ref) || !e.Properties[0].Value.(*datastore.Key).Equal(parent) {
+				t.Errorf("Nested entity changed - %+v", e)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(p, props[i]) {
+			t.Errorf("Property changed - %#v %#v", p, props[i])
+		}
+	}
+}
+
+type apiCall struct {
+	service, method string
+}
+
+func TestDegradedWrites(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test")
+	writable := false
+	defer SetCapabilityEnabled(func(c context.Context, api, capability string) bool {
+		return writable || capability != "write"
+	})()
+	calls := []apiCall{}
+	//The App Engine middleware gives a request context that the log API accepts
+	base := context.Background()
+	appengine.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base = r.Context()
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c := appengine.WithAPICallFunc(base, func(ctx context.Context, service, method string, in, out protoiface.MessageV1) error {
+		calls = append(calls, apiCall{service, method})
+		return nil
+	})
+
+	status := GetServiceStatus(c)
+	if !status.IsDegraded() || status.DatastoreWrite || !status.DatastoreRead {
+		t.Errorf("Invalid status - %+v", status)
+	}
+	type entity struct {
+		Name string
+	}
+	if _, err := PutInDatastoreSimple(c, "Kind", "id", &entity{"a"}); !errors.Is(err, ErrServiceUnavailable) {
+		t.Errorf("Write not refused - %v", err)
+	}
+	if _, _, err := PutInDatastoreSimpleOrQueue(c, "Kind", "", &entity{"a"}); !errors.Is(err, ErrServiceUnavailable) {
+		t.Errorf("Write without an ID queued - %v", err)
+	}
+	if len(calls) != 0 {
+		t.Errorf("Datastore called while read-only - %v", calls)
+	}
+
+	before := GetServiceStatus(c).InstanceQueuedWrites
+	key, queued, err := PutInDatastoreSimpleOrQueue(c, "Kind", "id", &entity{"a"})
+	if err != nil || !queued || key.StringID() != "id" {
+		t.Errorf("Write not queued - %v %v %v", key, queued, err)
+	}
+	if len(calls) != 1 || calls[0].service != "taskqueue" {
+		t.Errorf("Invalid calls - %v", calls)
+	}
+	if GetServiceStatus(c).InstanceQueuedWrites != before+1 {
+		t.Errorf("Queued write not counted")
+	}
+
+	w := httptest.NewRecorder()
+	ServiceStatusHandler(w, httptest.NewRequest("GET", "/_status", nil).WithContext(c))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Degraded status not reported - %v", w.Code)
+	}
+
+	//Once datastore is writable the entity and its version are put directly. The fake
+	//datastore doesn't answer with keys, so the put itself reports an error.
+	writable = true
+	RefreshServiceStatus(c)
+	calls = calls[:0]
+	if _, queued, _ := PutInDatastoreSimpleOrQueue(c, "Kind", "id", &entity{"b"}); queued {
+		t.Errorf("Write queued while datastore is writable")
+	}
+	if len(calls) != 1 || calls[0].service != "datastore_v3" || calls[0].method != "Put" {
+		t.Errorf("Invalid calls - %v", calls)
+	}
+}
@@ -0,0 +1,111 @@
+package Datastore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// Sentinel errors returned (wrapped in an *OpError) by the helpers in this package.
+// Use errors.Is to check for them.
+var (
+	ErrNotFound           = errors.New("entity not found")
+	ErrCacheMiss          = errors.New("cache miss")
+	ErrServiceUnavailable = errors.New("service unavailable")
+	ErrDecode             = errors.New("decode failure")
+	ErrEncode             = errors.New("encode failure")
+	ErrTooLarge           = errors.New("value too large")
+)
+
+// Largest value that will be sent to memcache
+const MaxMemcacheValueSize int = 1000000
+
+// OpError describes a failed helper call. Err holds one of the sentinel errors
+// above (or nil if the failure doesn't fit any of them), Cause holds the
+// underlying App Engine error, if any. Both are reachable through errors.Is/As.
+type OpError struct {
+	Op    string
+	Kind  string
+	Key   string
+	Err   error
+	Cause error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Kind != "" || e.Key != "" {
+		s += " " + e.Kind + ":" + e.Key
+	}
+	switch {
+	case e.Cause != nil:
+		return s + " - " + e.Cause.Error()
+	case e.Err != nil:
+		return s + " - " + e.Err.Error()
+	}
+	return s + " - unknown error"
+}
+
+func (e *OpError) Unwrap() []error {
+	answer := []error{}
+	if e.Err != nil {
+		answer = append(answer, e.Err)
+	}
+	if e.Cause != nil {
+		answer = append(answer, e.Cause)
+	}
+	return answer
+}
+
+// Wraps an error returned by App Engine into an *OpError with a matching sentinel
+func wrapError(op, kind, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+	return &OpError{Op: op, Kind: kind, Key: key, Err: classifyError(err), Cause: err}
+}
+
+// Creates an *OpError that has no underlying App Engine error
+func newError(op, kind, key string, sentinel error) error {
+	return &OpError{Op: op, Kind: kind, Key: key, Err: sentinel}
+}
+
+func classifyError(err error) error {
+	var fieldMismatch *datastore.ErrFieldMismatch
+	switch {
+	case errors.Is(err, datastore.ErrNoSuchEntity):
+		return ErrNotFound
+	case errors.Is(err, memcache.ErrCacheMiss):
+		return ErrCacheMiss
+	case errors.As(err, &fieldMismatch):
+		return ErrDecode
+	case errors.Is(err, memcache.ErrServerError), appengine.IsOverQuota(err), appengine.IsTimeoutError(err):
+		return ErrServiceUnavailable
+	}
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "capability_disabled"):
+		return ErrServiceUnavailable
+	case strings.Contains(msg, "too big"), strings.Contains(msg, "too large"):
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func keyName(stringID string, intID int64) string {
+	if stringID != "" || intID == 0 {
+		return stringID
+	}
+	return strconv.FormatInt(intID, 10)
+}
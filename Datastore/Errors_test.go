@@ -0,0 +1,69 @@
+package Datastore_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/ThePiachu/Go/Datastore"
+)
+
+func TestOpErrorUnwrap(t *testing.T) {
+	var err error = &OpError{Op: "GetFromDatastore", Kind: "kind", Key: "id", Err: ErrNotFound, Cause: datastore.ErrNoSuchEntity}
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("Error doesn't match ErrNotFound")
+	}
+	if !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("Error doesn't match datastore.ErrNoSuchEntity")
+	}
+	if errors.Is(err, ErrCacheMiss) {
+		t.Errorf("Error matches ErrCacheMiss")
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Kind != "kind" {
+		t.Errorf("Error is not an *OpError")
+	}
+	if err.Error() != "GetFromDatastore kind:id - datastore: no such entity" {
+		t.Errorf("Invalid error message - %v", err)
+	}
+}
+
+func TestWrapErrorClassification(t *testing.T) {
+	tests := []struct {
+		err      error
+		sentinel error
+	}{
+		{datastore.ErrNoSuchEntity, ErrNotFound},
+		{memcache.ErrCacheMiss, ErrCacheMiss},
+		{memcache.ErrServerError, ErrServiceUnavailable},
+		{&datastore.ErrFieldMismatch{FieldName: "Name", Reason: "no such struct field"}, ErrDecode},
+		{errors.New("API error 1 (datastore_v3: CAPABILITY_DISABLED)"), ErrServiceUnavailable},
+		{errors.New("entity is too big"), ErrTooLarge},
+		{errors.New("value too large"), ErrTooLarge},
+	}
+	for _, test := range tests {
+		err := WrapError("Op", "kind", "id", test.err)
+		if !errors.Is(err, test.sentinel) || !errors.Is(err, test.err) {
+			t.Errorf("%v not classified as %v - %v", test.err, test.sentinel, err)
+		}
+	}
+
+	err := WrapError("Op", "kind", "id", errors.New("something else"))
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Err != nil {
+		t.Errorf("Unknown error classified - %v", err)
+	}
+	if WrapError("Op", "kind", "id", nil) != nil {
+		t.Errorf("nil error wrapped")
+	}
+	if WrapError("Outer", "kind", "id", err) != err {
+		t.Errorf("*OpError wrapped twice")
+	}
+}
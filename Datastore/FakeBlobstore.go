@@ -7,6 +7,7 @@ package Datastore
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/v2/datastore"
@@ -30,7 +31,7 @@ func PutInFakeBlobstore(c context.Context, kind, stringID string, toStore interf
 	err := enc.Encode(toStore)
 	if err != nil {
 		Log.Errorf(c, "PutInFakeBlobstore error for key %s:%s - %s", kind, stringID, err)
-		return err
+		return &OpError{Op: "PutInFakeBlobstore", Kind: kind, Key: stringID, Err: ErrEncode, Cause: err}
 	}
 
 	err = datastore.RunInTransaction(c, func(c context.Context) error {
@@ -65,7 +66,7 @@ func GetFromFakeBlobstore(c context.Context, kind, stringID string, dst interfac
 		tmp := new(FakeBlobstoreData)
 		err := GetFromDatastoreSimple(c, FakeBlobstoreBucket, id, tmp)
 		if err != nil {
-			if err == datastore.ErrNoSuchEntity {
+			if errors.Is(err, ErrNotFound) {
 				break
 			}
 			Log.Errorf(c, "GetFromFakeBlobstore - %v", err)
@@ -85,7 +86,7 @@ func GetFromFakeBlobstore(c context.Context, kind, stringID string, dst interfac
 	err := dec.Decode(dst)
 	if err != nil {
 		Log.Errorf(c, "GetFromFakeBlobstore - %s", err)
-		return err
+		return &OpError{Op: "GetFromFakeBlobstore", Kind: kind, Key: stringID, Err: ErrDecode, Cause: err}
 	}
 
 	return nil
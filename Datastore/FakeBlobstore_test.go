@@ -14,11 +14,12 @@ import (
 )
 
 func TestFakeBlobstore(t *testing.T) {
-	c, err := aetest.NewContext(nil)
+	c, done, err := aetest.NewContext()
 	if err != nil {
-		t.Fatal(err)
+		//Needs dev_appserver.py from the App Engine SDK
+		t.Skipf("aetest.NewContext - %v", err)
 	}
-	defer c.Close()
+	defer done()
 
 	type temp struct {
 		ToStore string
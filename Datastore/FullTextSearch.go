@@ -0,0 +1,381 @@
+package Datastore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+// Inverted index kept in datastore. Every indexed entity gets a SearchDocument listing its
+// terms and one SearchPosting per distinct term. Postings are keyed by "kind:token" so that
+// both exact and prefix lookups only need the built-in single property index.
+//
+// Fields are marked for indexing with a struct tag:
+//
+//	type User struct {
+//		Name    string   `search:""`
+//		Aliases []string `search:""`
+//	}
+
+const SearchPostingKind = "SearchPosting"
+const SearchDocumentKind = "SearchDocument"
+
+// Tokens longer than this are truncated to keep posting keys short
+const MaxSearchTokenLength int = 64
+
+type SearchPosting struct {
+	Term  string
+	Doc   *datastore.Key
+	Count int `datastore:",noindex"`
+}
+
+type SearchDocument struct {
+	Kind  string
+	Doc   *datastore.Key
+	Terms []string `datastore:",noindex"`
+}
+
+type SearchResult struct {
+	Key   *datastore.Key
+	Score float64
+}
+
+// Lowercases the string and strips diacritics so that "Café" matches "cafe"
+func NormalizeSearchToken(s string) string {
+	decomposed := norm.NFKD.String(strings.ToLower(s))
+	answer := make([]rune, 0, len(decomposed))
+	for _, r := range decomposed {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		answer = append(answer, r)
+		if len(answer) == MaxSearchTokenLength {
+			break
+		}
+	}
+	return string(answer)
+}
+
+// Splits text on anything that isn't a letter or a digit and normalizes the pieces
+func TokenizeForSearch(s string) []string {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	answer := make([]string, 0, len(fields))
+	for _, f := range fields {
+		token := NormalizeSearchToken(f)
+		if token != "" {
+			answer = append(answer, token)
+		}
+	}
+	return answer
+}
+
+// Returns the token counts for all the fields of src tagged with `search`
+func ExtractSearchTokens(src interface{}) map[string]int {
+	answer := map[string]int{}
+	v := reflect.Indirect(reflect.ValueOf(src))
+	if v.Kind() != reflect.Struct {
+		return answer
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, ok := t.Field(i).Tag.Lookup("search")
+		if !ok || tag == "-" {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			for _, token := range TokenizeForSearch(field.String()) {
+				answer[token]++
+			}
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				continue
+			}
+			for j := 0; j < field.Len(); j++ {
+				for _, token := range TokenizeForSearch(field.Index(j).String()) {
+					answer[token]++
+				}
+			}
+		}
+	}
+	return answer
+}
+
+func searchTerm(kind, token string) string {
+	return kind + ":" + token
+}
+
+func searchPostingKey(c context.Context, term string, doc *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, SearchPostingKind, term+"|"+doc.Encode(), 0, nil)
+}
+
+func searchDocumentKey(c context.Context, doc *datastore.Key) *datastore.Key {
+	return datastore.NewKey(c, SearchDocumentKind, doc.Encode(), 0, nil)
+}
+
+// Updates the search index for the entity stored under key
+func IndexForSearch(c context.Context, key *datastore.Key, src interface{}) error {
+	kind := key.Kind()
+	counts := ExtractSearchTokens(src)
+
+	docKey := searchDocumentKey(c, key)
+	oldDoc := new(SearchDocument)
+	err := datastore.Get(c, docKey, oldDoc)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return wrapError("IndexForSearch", kind, key.StringID(), err)
+	}
+
+	toDelete := []*datastore.Key{}
+	for _, term := range oldDoc.Terms {
+		if _, ok := counts[strings.TrimPrefix(term, kind+":")]; !ok {
+			toDelete = append(toDelete, searchPostingKey(c, term, key))
+		}
+	}
+
+	doc := &SearchDocument{Kind: kind, Doc: key}
+	postingKeys := make([]*datastore.Key, 0, len(counts))
+	postings := make([]*SearchPosting, 0, len(counts))
+	for token, count := range counts {
+		term := searchTerm(kind, token)
+		doc.Terms = append(doc.Terms, term)
+		postingKeys = append(postingKeys, searchPostingKey(c, term, key))
+		postings = append(postings, &SearchPosting{Term: term, Doc: key, Count: count})
+	}
+	sort.Strings(doc.Terms)
+
+	for len(postingKeys) > 0 {
+		n := len(postingKeys)
+		if n > MaxPutMultiSize {
+			n = MaxPutMultiSize
+		}
+		if _, err := datastore.PutMulti(c, postingKeys[:n], postings[:n]); err != nil {
+			return wrapError("IndexForSearch", kind, key.StringID(), err)
+		}
+		postingKeys, postings = postingKeys[n:], postings[n:]
+	}
+	if err := deleteKeysInBatches(c, toDelete); err != nil {
+		return wrapError("IndexForSearch", kind, key.StringID(), err)
+	}
+	if _, err := datastore.Put(c, docKey, doc); err != nil {
+		return wrapError("IndexForSearch", kind, key.StringID(), err)
+	}
+	return nil
+}
+
+// Removes the entity stored under key from the search index
+func RemoveFromSearchIndex(c context.Context, key *datastore.Key) error {
+	docKey := searchDocumentKey(c, key)
+	doc := new(SearchDocument)
+	err := datastore.Get(c, docKey, doc)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return wrapError("RemoveFromSearchIndex", key.Kind(), key.StringID(), err)
+	}
+	toDelete := []*datastore.Key{docKey}
+	for _, term := range doc.Terms {
+		toDelete = append(toDelete, searchPostingKey(c, term, key))
+	}
+	return wrapError("RemoveFromSearchIndex", key.Kind(), key.StringID(), deleteKeysInBatches(c, toDelete))
+}
+
+func deleteKeysInBatches(c context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > MaxPutMultiSize {
+			n = MaxPutMultiSize
+		}
+		if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func PutInDatastoreSimpleAndIndex(c context.Context, kind, stringID string, variable interface{}) (*datastore.Key, error) {
+	key, err := PutInDatastoreSimple(c, kind, stringID, variable)
+	if err != nil {
+		return nil, err
+	}
+	return key, IndexForSearch(c, key, variable)
+}
+
+func DeleteFromDatastoreSimpleAndIndex(c context.Context, kind, stringID string) error {
+	key := datastore.NewKey(c, kind, stringID, 0, nil)
+	if err := RemoveFromSearchIndex(c, key); err != nil {
+		return err
+	}
+	return DeleteFromDatastoreSimple(c, kind, stringID)
+}
+
+// Indexes every existing entity of the given kind. prototype is a pointer to the struct
+// the entities are loaded into. Returns the number of entities indexed.
+func ReindexKind(c context.Context, kind string, prototype interface{}) (int, error) {
+	t := reflect.TypeOf(prototype)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return 0, errors.New("ReindexKind - prototype must be a pointer")
+	}
+	t = t.Elem()
+	count := 0
+	it := datastore.NewQuery(kind).Run(c)
+	for {
+		dst := reflect.New(t).Interface()
+		key, err := it.Next(dst)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+				return count, wrapError("ReindexKind", kind, "", err)
+			}
+		}
+		if err = IndexForSearch(c, key, dst); err != nil {
+			return count, err
+		}
+		count++
+		if count%1000 == 0 {
+			Log.Infof(c, "ReindexKind - %v - %v entities indexed", kind, count)
+		}
+	}
+	return count, nil
+}
+
+// A single search term. Prefix terms match every token starting with Token.
+type SearchQueryTerm struct {
+	Token  string
+	Prefix bool
+}
+
+// Terms within a group are ANDed together, groups are ORed
+type SearchQuery [][]SearchQueryTerm
+
+// Parses a query such as "john smi* OR jsmith". Words are ANDed, "OR" separates
+// alternatives and a trailing "*" turns a word into a prefix match.
+func ParseSearchQuery(query string) SearchQuery {
+	answer := SearchQuery{}
+	group := []SearchQueryTerm{}
+	for _, word := range strings.Fields(query) {
+		if word == "OR" {
+			if len(group) > 0 {
+				answer = append(answer, group)
+			}
+			group = []SearchQueryTerm{}
+			continue
+		}
+		prefix := strings.HasSuffix(word, "*")
+		tokens := TokenizeForSearch(word)
+		for i, token := range tokens {
+			group = append(group, SearchQueryTerm{Token: token, Prefix: prefix && i == len(tokens)-1})
+		}
+	}
+	if len(group) > 0 {
+		answer = append(answer, group)
+	}
+	return answer
+}
+
+// Searches entities of the given kind, returning at most limit results ordered by
+// relevance (term frequency weighted by how rare the term is). limit < 0 means no limit.
+func Search(c context.Context, kind string, query string, limit int) ([]SearchResult, error) {
+	parsed := ParseSearchQuery(query)
+	if len(parsed) == 0 {
+		return []SearchResult{}, nil
+	}
+	total, err := datastore.NewQuery(SearchDocumentKind).Filter("Kind =", kind).KeysOnly().Count(c)
+	if err != nil {
+		return nil, wrapError("Search", kind, "", err)
+	}
+
+	scores := map[string]float64{}
+	keys := map[string]*datastore.Key{}
+	for _, group := range parsed {
+		var groupScores map[string]float64
+		for _, term := range group {
+			postings, err := searchPostings(c, kind, term)
+			if err != nil {
+				return nil, err
+			}
+			termScores := scoreSearchPostings(postings, total)
+			for _, p := range postings {
+				keys[p.Doc.Encode()] = p.Doc
+			}
+			if groupScores == nil {
+				groupScores = termScores
+				continue
+			}
+			for doc, score := range groupScores {
+				if s, ok := termScores[doc]; ok {
+					groupScores[doc] = score + s
+				} else {
+					delete(groupScores, doc)
+				}
+			}
+		}
+		for doc, score := range groupScores {
+			if score > scores[doc] {
+				scores[doc] = score
+			}
+		}
+	}
+
+	answer := make([]SearchResult, 0, len(scores))
+	for doc, score := range scores {
+		answer = append(answer, SearchResult{Key: keys[doc], Score: score})
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		if answer[i].Score != answer[j].Score {
+			return answer[i].Score > answer[j].Score
+		}
+		return answer[i].Key.String() < answer[j].Key.String()
+	})
+	if limit >= 0 && len(answer) > limit {
+		answer = answer[:limit]
+	}
+	return answer, nil
+}
+
+func searchPostings(c context.Context, kind string, term SearchQueryTerm) ([]SearchPosting, error) {
+	q := datastore.NewQuery(SearchPostingKind)
+	if term.Prefix {
+		q = q.Filter("Term >=", searchTerm(kind, term.Token)).Filter("Term <", searchTerm(kind, term.Token)+"\uffff")
+	} else {
+		q = q.Filter("Term =", searchTerm(kind, term.Token))
+	}
+	postings := []SearchPosting{}
+	if _, err := q.GetAll(c, &postings); err != nil {
+		return nil, wrapError("Search", kind, term.Token, err)
+	}
+	return postings, nil
+}
+
+// Scores documents by tf-idf. A prefix term may match several tokens of a document,
+// their frequencies are summed.
+func scoreSearchPostings(postings []SearchPosting, total int) map[string]float64 {
+	counts := map[string]int{}
+	for _, p := range postings {
+		counts[p.Doc.Encode()] += p.Count
+	}
+	idf := math.Log(1 + float64(total)/float64(len(counts)+1))
+	answer := make(map[string]float64, len(counts))
+	for doc, count := range counts {
+		answer[doc] = float64(count) * idf
+	}
+	return answer
+}
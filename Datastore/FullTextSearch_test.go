@@ -0,0 +1,57 @@
+package Datastore_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"reflect"
+	"testing"
+
+	. "github.com/ThePiachu/Go/Datastore"
+	"golang.org/x/net/context"
+)
+
+func TestTokenizeForSearch(t *testing.T) {
+	tokens := TokenizeForSearch("Żółw, 12 Main-Street")
+	expected := []string{"zołw", "12", "main", "street"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Invalid tokens - %v", tokens)
+	}
+}
+
+func TestExtractSearchTokens(t *testing.T) {
+	type temp struct {
+		Name    string   `search:""`
+		Aliases []string `search:""`
+		Secret  string
+	}
+	counts := ExtractSearchTokens(&temp{Name: "John Smith", Aliases: []string{"john"}, Secret: "hidden"})
+	expected := map[string]int{"john": 2, "smith": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Invalid token counts - %v", counts)
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	query := ParseSearchQuery("john smi* OR jsmith")
+	expected := SearchQuery{
+		{{Token: "john"}, {Token: "smi", Prefix: true}},
+		{{Token: "jsmith"}},
+	}
+	if !reflect.DeepEqual(query, expected) {
+		t.Errorf("Invalid query - %v", query)
+	}
+}
+
+func TestReindexKindPrototype(t *testing.T) {
+	type temp struct {
+		Name string `search:""`
+	}
+	if _, err := ReindexKind(context.Background(), "Kind", temp{}); err == nil {
+		t.Errorf("Non-pointer prototype accepted")
+	}
+	if _, err := ReindexKind(context.Background(), "Kind", nil); err == nil {
+		t.Errorf("Nil prototype accepted")
+	}
+}
@@ -56,17 +56,17 @@ func GetFromBlobstore(c context.Context, blobkey appengine.BlobKey, dst interfac
 	data, err := ioutil.ReadAll(reader)
 	if err != nil {
 		Log.Errorf(c, "GetFromBlobstore - %s", err)
-		return nil, err
+		return nil, wrapError("GetFromBlobstore", "", string(blobkey), err)
 	}
 	dec := gob.NewDecoder(bytes.NewBuffer(data))
 	err = dec.Decode(dst)
 	if err != nil {
 		Log.Errorf(c, "GetFromBlobstore - %s", err)
-		return nil, err
+		return nil, &OpError{Op: "GetFromBlobstore", Key: string(blobkey), Err: ErrDecode, Cause: err}
 	}
 	return dst, nil
 }
 
 func DeleteFromBlobstore(c context.Context, blobkey appengine.BlobKey) error {
-	return blobstore.Delete(c, blobkey)
+	return wrapError("DeleteFromBlobstore", "", string(blobkey), blobstore.Delete(c, blobkey))
 }
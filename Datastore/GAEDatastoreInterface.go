@@ -5,15 +5,21 @@ package Datastore
 // license that can be found in the LICENSE file.
 
 import (
+	"errors"
 	"github.com/ThePiachu/Go/Log"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/v2/datastore"
 )
 
+// Fails fast with ErrServiceUnavailable while datastore is read-only, see Degraded.go
 func PutInDatastoreFull(c context.Context, kind, stringID string, intID int64, parent *datastore.Key, variable interface{}) (*datastore.Key, error) {
+	if !IsDatastoreWritable(c) {
+		return nil, newError("PutInDatastore", kind, keyName(stringID, intID), ErrServiceUnavailable)
+	}
 	k := datastore.NewKey(c, kind, stringID, intID, parent)
 	key, err := datastore.Put(c, k, variable)
-	return key, err
+	noteWriteError(err)
+	return key, wrapError("PutInDatastore", kind, keyName(stringID, intID), err)
 }
 
 func PutInDatastoreSimple(c context.Context, kind, stringID string, variable interface{}) (*datastore.Key, error) {
@@ -30,7 +36,7 @@ func PutInDatastore(c context.Context, kind string, variable interface{}) (*data
 
 func GetFromDatastoreFull(c context.Context, kind, stringID string, intID int64, parent *datastore.Key, dst interface{}) error {
 	k := datastore.NewKey(c, kind, stringID, intID, parent)
-	return datastore.Get(c, k, dst)
+	return wrapError("GetFromDatastore", kind, keyName(stringID, intID), datastore.Get(c, k, dst))
 }
 
 func GetFromDatastoreSimple(c context.Context, kind, stringID string, dst interface{}) error {
@@ -45,20 +51,21 @@ func GetFromDatastoreSimpleWithParent(c context.Context, kind, stringID string,
 func GetFromDatastoreOrSetDefaultFull(c context.Context, kind, stringID string, intID int64, parent *datastore.Key, dst interface{}, def interface{}) error {
 
 	key := datastore.NewKey(c, kind, stringID, intID, parent)
+	name := keyName(stringID, intID)
 	if err := datastore.Get(c, key, dst); err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			_, err2 := datastore.Put(c, key, def)
 
 			if err2 != nil {
-				return err2
+				return wrapError("GetFromDatastoreOrSetDefault", kind, name, err2)
 			} else {
 				if err3 := datastore.Get(c, key, dst); err3 != nil {
-					return err3
+					return wrapError("GetFromDatastoreOrSetDefault", kind, name, err3)
 				}
 			}
 
 		} else {
-			return err
+			return wrapError("GetFromDatastoreOrSetDefault", kind, name, err)
 		}
 	}
 	return nil
@@ -68,26 +75,37 @@ func GetFromDatastoreOrSetDefaultSimple(c context.Context, kind, stringID string
 	return GetFromDatastoreOrSetDefaultFull(c, kind, stringID, 0, nil, dst, def)
 }
 
+// Deprecated: use IsVariableInDatastoreSimpleWithError, which doesn't hide errors.
 func IsVariableInDatastoreSimple(c context.Context, kind, stringID string, dst interface{}) bool {
+	found, err := IsVariableInDatastoreSimpleWithError(c, kind, stringID, dst)
+	if err != nil {
+		Log.Errorf(c, "IsVariableInDatastoreSimple - %s", err)
+	}
+	return found
+}
+
+// Reports whether the entity exists. A missing entity is not an error.
+func IsVariableInDatastoreSimpleWithError(c context.Context, kind, stringID string, dst interface{}) (bool, error) {
 	err := GetFromDatastoreSimple(c, kind, stringID, dst)
 	if err == nil {
-		return true
+		return true, nil
 	}
-	if err == datastore.ErrNoSuchEntity {
-		return false
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
 	}
-	Log.Errorf(c, "IsVariableInDatastoreSimple - %s", err)
-	return false
+	return false, err
 }
 
 func QueryGetFirstBy(c context.Context, kind string, order string, limit int, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Order(order).Limit(limit)
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetFirstBy", kind, "", err)
 }
 
 func QueryGetFirstKeysBy(c context.Context, kind string, order string, limit int, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Order(order).Limit(limit).KeysOnly()
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetFirstKeysBy", kind, "", err)
 }
 func QueryGetAllWithFilter(c context.Context, kind string, filterStr string, filterValue interface{}, dst interface{}) ([]*datastore.Key, error) {
 	return QueryGetAllWithFilterAndLimit(c, kind, filterStr, filterValue, -1, dst)
@@ -95,17 +113,20 @@ func QueryGetAllWithFilter(c context.Context, kind string, filterStr string, fil
 
 func QueryGetAllWithFilterAndLimit(c context.Context, kind string, filterStr string, filterValue interface{}, limit int, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Filter(filterStr, filterValue).Limit(limit)
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllWithFilterAndLimit", kind, "", err)
 }
 
 func QueryGetAllWithLimit(c context.Context, kind string, limit int, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Limit(limit)
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllWithLimit", kind, "", err)
 }
 
 func QueryGetAll(c context.Context, kind string, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind)
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAll", kind, "", err)
 }
 
 func QueryGetAllKeysWithFilterAndOrder(c context.Context, kind string, filterStr string, filterValue interface{}, orderStr string, dst interface{}) ([]*datastore.Key, error) {
@@ -114,35 +135,49 @@ func QueryGetAllKeysWithFilterAndOrder(c context.Context, kind string, filterStr
 
 func QueryGetAllKeysWithFilterLimitAndOrder(c context.Context, kind string, filterStr string, filterValue interface{}, limit int, orderStr string, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Filter(filterStr, filterValue).Limit(limit).Order(orderStr).KeysOnly()
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllKeysWithFilterLimitAndOrder", kind, "", err)
 }
 
 func QueryGetAllKeysWithFilterLimitOffsetAndOrder(c context.Context, kind string, filterStr string, filterValue interface{}, limit int, offset int, orderStr string, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).Filter(filterStr, filterValue).Limit(limit).Offset(offset).Order(orderStr).KeysOnly()
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllKeysWithFilterLimitOffsetAndOrder", kind, "", err)
 }
 
+// Deprecated: use QueryGetAllKeysWithFilterWithError. Panics on error.
 func QueryGetAllKeysWithFilter(c context.Context, kind string, filterStr string, filterValue interface{}, dst interface{}) []*datastore.Key {
 	return QueryGetAllKeysWithFilterAndLimit(c, kind, filterStr, filterValue, -1, dst)
 }
 
+// Deprecated: use QueryGetAllKeysWithFilterAndLimitWithError. Panics on error.
 func QueryGetAllKeysWithFilterAndLimit(c context.Context, kind string, filterStr string, filterValue interface{}, limit int, dst interface{}) []*datastore.Key {
-	q := datastore.NewQuery(kind).Filter(filterStr, filterValue).Limit(limit).KeysOnly()
-	keys, err := q.GetAll(c, dst)
+	keys, err := QueryGetAllKeysWithFilterAndLimitWithError(c, kind, filterStr, filterValue, limit, dst)
 	if err != nil {
 		panic(err)
 	}
 	return keys
 }
 
+func QueryGetAllKeysWithFilterWithError(c context.Context, kind string, filterStr string, filterValue interface{}, dst interface{}) ([]*datastore.Key, error) {
+	return QueryGetAllKeysWithFilterAndLimitWithError(c, kind, filterStr, filterValue, -1, dst)
+}
+
+func QueryGetAllKeysWithFilterAndLimitWithError(c context.Context, kind string, filterStr string, filterValue interface{}, limit int, dst interface{}) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(kind).Filter(filterStr, filterValue).Limit(limit).KeysOnly()
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllKeysWithFilterAndLimit", kind, "", err)
+}
+
 func QueryGetAllKeys(c context.Context, kind string, dst interface{}) ([]*datastore.Key, error) {
 	q := datastore.NewQuery(kind).KeysOnly()
-	return q.GetAll(c, dst)
+	keys, err := q.GetAll(c, dst)
+	return keys, wrapError("QueryGetAllKeys", kind, "", err)
 }
 
+// Deprecated: use CountQueryWithFilterWithError. Returns -1 on error.
 func CountQueryWithFilter(c context.Context, kind string, filterStr string, filterValue interface{}) int {
-	q := datastore.NewQuery(kind).Filter(filterStr, filterValue)
-	count, err := q.Count(c)
+	count, err := CountQueryWithFilterWithError(c, kind, filterStr, filterValue)
 	if err != nil {
 		Log.Errorf(c, "CountQueryWithFilter - %s", err)
 		return -1
@@ -150,6 +185,15 @@ func CountQueryWithFilter(c context.Context, kind string, filterStr string, filt
 	return count
 }
 
+func CountQueryWithFilterWithError(c context.Context, kind string, filterStr string, filterValue interface{}) (int, error) {
+	q := datastore.NewQuery(kind).Filter(filterStr, filterValue)
+	count, err := q.Count(c)
+	if err != nil {
+		return 0, wrapError("CountQueryWithFilter", kind, "", err)
+	}
+	return count, nil
+}
+
 func ClearNamespace(c context.Context, kind string) error {
 	q := datastore.NewQuery(kind)
 	q = q.KeysOnly()
@@ -158,7 +202,7 @@ func ClearNamespace(c context.Context, kind string) error {
 
 	if err != nil {
 		Log.Errorf(c, "Clear Namespace - %v", err)
-		return err
+		return wrapError("ClearNamespace", kind, "", err)
 	}
 
 	for {
@@ -170,7 +214,7 @@ func ClearNamespace(c context.Context, kind string) error {
 		err = datastore.DeleteMulti(c, toDelete)
 		if err != nil {
 			Log.Errorf(c, "ClearNamespace - %v", err)
-			return err
+			return wrapError("ClearNamespace", kind, "", err)
 		}
 		if len(keys) < 500 {
 			break
@@ -182,7 +226,7 @@ func ClearNamespace(c context.Context, kind string) error {
 
 func DeleteFromDatastoreFull(c context.Context, kind, stringID string, intID int64, parent *datastore.Key) error {
 	k := datastore.NewKey(c, kind, stringID, intID, parent)
-	return datastore.Delete(c, k)
+	return wrapError("DeleteFromDatastore", kind, keyName(stringID, intID), datastore.Delete(c, k))
 }
 
 func DeleteFromDatastoreSimple(c context.Context, kind, stringID string) error {
@@ -10,9 +10,11 @@ import (
 	"errors"
 	"github.com/ThePiachu/Go/Log"
 	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
 	"google.golang.org/appengine/v2/capability"
 	"google.golang.org/appengine/v2/datastore"
 	"google.golang.org/appengine/v2/memcache"
+	"reflect"
 )
 
 func init() {
@@ -23,7 +25,7 @@ func init() {
 func PutInMemcache(c context.Context, key string, toStore interface{}) error {
 	if !capability.Enabled(c, "memcache", "*") {
 		Log.Errorf(c, "PutInMemcache - Memcache not available.")
-		return nil
+		return newError("PutInMemcache", "", key, ErrServiceUnavailable)
 	}
 	var data bytes.Buffer
 
@@ -32,7 +34,11 @@ func PutInMemcache(c context.Context, key string, toStore interface{}) error {
 	err := enc.Encode(toStore)
 	if err != nil {
 		Log.Errorf(c, "PutInMemcache error for key %s - %s", key, err)
-		return err
+		return &OpError{Op: "PutInMemcache", Key: key, Err: ErrEncode, Cause: err}
+	}
+	if data.Len() > MaxMemcacheValueSize {
+		Log.Errorf(c, "PutInMemcache - value for key %s is %d bytes", key, data.Len())
+		return newError("PutInMemcache", "", key, ErrTooLarge)
 	}
 
 	item := &memcache.Item{
@@ -41,38 +47,48 @@ func PutInMemcache(c context.Context, key string, toStore interface{}) error {
 	}
 	if err := memcache.Set(c, item); err != nil {
 		Log.Errorf(c, "PutInMemcache - %s", err)
+		return wrapError("PutInMemcache", "", key, err)
 	}
-	return err
+	return nil
 }
 
+// Deprecated: use GetFromMemcacheWithError. Returns dst on success and nil on any failure.
 func GetFromMemcache(c context.Context, key string, dst interface{}) interface{} {
-	if !capability.Enabled(c, "memcache", "*") {
-		Log.Errorf(c, "GetFromMemcache - Memcache not available.")
+	err := GetFromMemcacheWithError(c, key, dst)
+	if err != nil {
+		if !errors.Is(err, ErrCacheMiss) {
+			Log.Errorf(c, "GetFromMemcache - %s", err)
+		}
 		return nil
 	}
+	return dst
+}
+
+// Loads the value stored under key into dst. Returns an error wrapping ErrCacheMiss
+// if the key is not present.
+func GetFromMemcacheWithError(c context.Context, key string, dst interface{}) error {
+	if !capability.Enabled(c, "memcache", "*") {
+		return newError("GetFromMemcache", "", key, ErrServiceUnavailable)
+	}
 
 	item, err := memcache.Get(c, key)
-	if err != nil && err != memcache.ErrCacheMiss {
-		Log.Errorf(c, "GetFromMemcache - %s", err)
-		return nil
-	} else if err == memcache.ErrCacheMiss {
-		return nil
+	if err != nil {
+		return wrapError("GetFromMemcache", "", key, err)
 	}
 
 	dec := gob.NewDecoder(bytes.NewBuffer(item.Value))
 	err = dec.Decode(dst)
 	if err != nil {
-		Log.Errorf(c, "GetFromMemcache - %s", err)
-		return nil
+		return &OpError{Op: "GetFromMemcache", Key: key, Err: ErrDecode, Cause: err}
 	}
 
-	return dst
+	return nil
 }
 
 func PutInDatastoreSimpleAndMemcache(c context.Context, kind, stringID, memcacheID string, variable interface{}) (*datastore.Key, error) {
 	if !capability.Enabled(c, "datastore_v3", "*") {
 		Log.Errorf(c, "PutInDatastoreSimpleAndMemcache - Datastore not available.")
-		return nil, errors.New("Datastore not available")
+		return nil, newError("PutInDatastoreSimpleAndMemcache", kind, stringID, ErrServiceUnavailable)
 	}
 
 	key, err := PutInDatastoreSimple(c, kind, stringID, variable)
@@ -90,15 +106,17 @@ func PutInDatastoreSimpleAndMemcache(c context.Context, kind, stringID, memcache
 
 func GetFromDatastoreSimpleOrMemcache(c context.Context, kind, stringID, memcacheID string, dst interface{}) error {
 	if capability.Enabled(c, "memcache", "*") {
-		answer := GetFromMemcache(c, memcacheID, dst)
-		if answer != nil {
-			dst = answer
+		err := GetFromMemcacheWithError(c, memcacheID, dst)
+		if err == nil {
 			return nil
 		}
+		if !errors.Is(err, ErrCacheMiss) {
+			Log.Errorf(c, "GetFromDatastoreOrMemcache - %s", err)
+		}
 	}
 	if !capability.Enabled(c, "datastore_v3", "*") {
 		Log.Errorf(c, "GetFromDatastoreOrMemcache - Datastore not available.")
-		return errors.New("Datastore not available")
+		return newError("GetFromDatastoreSimpleOrMemcache", kind, stringID, ErrServiceUnavailable)
 	}
 
 	err := GetFromDatastoreSimple(c, kind, stringID, dst)
@@ -114,6 +132,116 @@ func GetFromDatastoreSimpleOrMemcache(c context.Context, kind, stringID, memcach
 	return nil
 }
 
+// Calls made by GetMultiFromDatastoreSimpleOrMemcache, replaced in tests
+var (
+	memcacheGetMulti  = memcache.GetMulti
+	memcacheSetMulti  = memcache.SetMulti
+	datastoreGetMulti = datastore.GetMulti
+)
+
+// Batched version of GetFromDatastoreSimpleOrMemcache. dst must be a slice of structs or
+// struct pointers of the same length as stringIDs and memcacheIDs; results are stored in input order.
+// Does a single memcache GetMulti, a single datastore GetMulti for the misses and backfills
+// memcache with one SetMulti. If some entities couldn't be loaded an appengine.MultiError is
+// returned, with entries wrapping ErrNotFound for the missing ones.
+func GetMultiFromDatastoreSimpleOrMemcache(c context.Context, kind string, stringIDs, memcacheIDs []string, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(stringIDs) || len(stringIDs) != len(memcacheIDs) {
+		return errors.New("GetMultiFromDatastoreSimpleOrMemcache - dst, stringIDs and memcacheIDs must have the same length")
+	}
+	if len(stringIDs) == 0 {
+		return nil
+	}
+
+	misses := []int{}
+	if capability.Enabled(c, "memcache", "*") {
+		items, err := memcacheGetMulti(c, memcacheIDs)
+		if err != nil {
+			Log.Errorf(c, "GetMultiFromDatastoreSimpleOrMemcache - %s", err)
+		}
+		for i, memcacheID := range memcacheIDs {
+			item, ok := items[memcacheID]
+			if !ok {
+				misses = append(misses, i)
+				continue
+			}
+			dec := gob.NewDecoder(bytes.NewBuffer(item.Value))
+			if err := dec.Decode(sliceElementPointer(v, i)); err != nil {
+				Log.Errorf(c, "GetMultiFromDatastoreSimpleOrMemcache - %s", err)
+				misses = append(misses, i)
+			}
+		}
+	} else {
+		for i := range memcacheIDs {
+			misses = append(misses, i)
+		}
+	}
+	if len(misses) == 0 {
+		return nil
+	}
+
+	if !capability.Enabled(c, "datastore_v3", "*") {
+		Log.Errorf(c, "GetMultiFromDatastoreSimpleOrMemcache - Datastore not available.")
+		return newError("GetMultiFromDatastoreSimpleOrMemcache", kind, "", ErrServiceUnavailable)
+	}
+
+	keys := make([]*datastore.Key, len(misses))
+	fetched := reflect.MakeSlice(v.Type(), len(misses), len(misses))
+	for j, i := range misses {
+		keys[j] = datastore.NewKey(c, kind, stringIDs[i], 0, nil)
+		fetched.Index(j).Set(v.Index(i))
+	}
+	err := datastoreGetMulti(c, keys, fetched.Interface())
+	multi, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return wrapError("GetMultiFromDatastoreSimpleOrMemcache", kind, "", err)
+	}
+
+	answer := make(appengine.MultiError, len(stringIDs))
+	failed := false
+	toCache := []*memcache.Item{}
+	for j, i := range misses {
+		if isMulti && multi[j] != nil {
+			answer[i] = wrapError("GetMultiFromDatastoreSimpleOrMemcache", kind, stringIDs[i], multi[j])
+			failed = true
+			continue
+		}
+		v.Index(i).Set(fetched.Index(j))
+
+		var data bytes.Buffer
+		enc := gob.NewEncoder(&data)
+		if err := enc.Encode(sliceElementPointer(v, i)); err != nil || data.Len() > MaxMemcacheValueSize {
+			continue
+		}
+		toCache = append(toCache, &memcache.Item{Key: memcacheIDs[i], Value: data.Bytes()})
+	}
+
+	if len(toCache) > 0 && capability.Enabled(c, "memcache", "*") {
+		if err := memcacheSetMulti(c, toCache); err != nil {
+			Log.Errorf(c, "GetMultiFromDatastoreSimpleOrMemcache - %s", err)
+		}
+	}
+
+	if failed {
+		return answer
+	}
+	return nil
+}
+
+// Returns a pointer to the i-th struct of a slice of structs or struct pointers,
+// allocating the struct if the slice holds a nil pointer
+func sliceElementPointer(v reflect.Value, i int) interface{} {
+	elem := v.Index(i)
+	if elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			elem.Set(reflect.New(elem.Type().Elem()))
+		}
+		return elem.Interface()
+	}
+	return elem.Addr().Interface()
+}
+
+// Deprecated: use IsVariableInDatastoreSimpleOrMemcacheWithError, which doesn't hide errors.
 func IsVariableInDatastoreSimpleOrMemcache(c context.Context, kind, stringID, memcacheID string, dst interface{}) bool {
 	_, err := memcache.Get(c, memcacheID)
 	if err == nil {
@@ -122,8 +250,22 @@ func IsVariableInDatastoreSimpleOrMemcache(c context.Context, kind, stringID, me
 	return IsVariableInDatastoreSimple(c, kind, stringID, dst)
 }
 
+func IsVariableInDatastoreSimpleOrMemcacheWithError(c context.Context, kind, stringID, memcacheID string, dst interface{}) (bool, error) {
+	_, err := memcache.Get(c, memcacheID)
+	if err == nil {
+		return true, nil
+	}
+	return IsVariableInDatastoreSimpleWithError(c, kind, stringID, dst)
+}
+
+// Deprecated: use DeleteFromMemcacheWithError.
 func DeleteFromMemcache(c context.Context, memcacheID string) {
-	memcache.Delete(c, memcacheID)
+	DeleteFromMemcacheWithError(c, memcacheID)
+}
+
+// Removes the key from memcache. Returns an error wrapping ErrCacheMiss if it was not present.
+func DeleteFromMemcacheWithError(c context.Context, memcacheID string) error {
+	return wrapError("DeleteFromMemcache", "", memcacheID, memcache.Delete(c, memcacheID))
 }
 
 func DeleteFromDatastoreSimpleAndMemcache(c context.Context, kind, stringID, memcacheID string) error {
@@ -132,7 +274,7 @@ func DeleteFromDatastoreSimpleAndMemcache(c context.Context, kind, stringID, mem
 }
 
 func FlushMemcache(c context.Context) error {
-	return memcache.Flush(c)
+	return wrapError("FlushMemcache", "", "", memcache.Flush(c))
 }
 
 func ClearNamespaceAndMemcache(c context.Context, kind string) error {
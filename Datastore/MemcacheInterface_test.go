@@ -0,0 +1,142 @@
+package Datastore_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+
+	. "github.com/ThePiachu/Go/Datastore"
+)
+
+type cachedEntity struct {
+	Name string
+}
+
+// In-memory memcache and datastore, recording the calls made to them
+type fakeCacheAndDatastore struct {
+	cache          map[string][]byte
+	entities       map[string]cachedEntity
+	datastoreCalls [][]string
+	cached         []string
+}
+
+func newFakeCacheAndDatastore(t *testing.T) *fakeCacheAndDatastore {
+	t.Setenv("GAE_APPLICATION", "s~test")
+	f := &fakeCacheAndDatastore{cache: map[string][]byte{}, entities: map[string]cachedEntity{}}
+	t.Cleanup(SetGetMultiCalls(f.memcacheGet, f.memcacheSet, f.datastoreGet))
+	return f
+}
+
+func (f *fakeCacheAndDatastore) putInCache(id string, e cachedEntity) {
+	var b bytes.Buffer
+	gob.NewEncoder(&b).Encode(&e)
+	f.cache[id] = b.Bytes()
+}
+
+func (f *fakeCacheAndDatastore) memcacheGet(c context.Context, keys []string) (map[string]*memcache.Item, error) {
+	answer := map[string]*memcache.Item{}
+	for _, key := range keys {
+		if value, ok := f.cache[key]; ok {
+			answer[key] = &memcache.Item{Key: key, Value: value}
+		}
+	}
+	return answer, nil
+}
+
+func (f *fakeCacheAndDatastore) memcacheSet(c context.Context, items []*memcache.Item) error {
+	for _, item := range items {
+		f.cache[item.Key] = item.Value
+		f.cached = append(f.cached, item.Key)
+	}
+	return nil
+}
+
+func (f *fakeCacheAndDatastore) datastoreGet(c context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	ids := []string{}
+	multi := make(appengine.MultiError, len(keys))
+	missing := false
+	for i, key := range keys {
+		ids = append(ids, key.StringID())
+		e, ok := f.entities[key.StringID()]
+		if !ok {
+			multi[i] = datastore.ErrNoSuchEntity
+			missing = true
+			continue
+		}
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			elem.Set(reflect.New(elem.Type().Elem()))
+			elem = elem.Elem()
+		}
+		elem.Set(reflect.ValueOf(e))
+	}
+	f.datastoreCalls = append(f.datastoreCalls, ids)
+	if missing {
+		return multi
+	}
+	return nil
+}
+
+func TestGetMultiFromDatastoreSimpleOrMemcache(t *testing.T) {
+	f := newFakeCacheAndDatastore(t)
+	c := context.Background()
+	f.putInCache("m-a", cachedEntity{"A"})
+	f.putInCache("m-b", cachedEntity{"B"})
+	f.entities["c"] = cachedEntity{"C"}
+
+	//Everything in memcache
+	dst := make([]cachedEntity, 2)
+	if err := GetMultiFromDatastoreSimpleOrMemcache(c, "kind", []string{"a", "b"}, []string{"m-a", "m-b"}, dst); err != nil {
+		t.Fatalf("Full hit - %v", err)
+	}
+	if dst[0].Name != "A" || dst[1].Name != "B" || len(f.datastoreCalls) != 0 {
+		t.Errorf("Invalid full hit - %v %v", dst, f.datastoreCalls)
+	}
+
+	//Misses are read from datastore and put in memcache
+	ptrs := make([]*cachedEntity, 2)
+	if err := GetMultiFromDatastoreSimpleOrMemcache(c, "kind", []string{"c", "a"}, []string{"m-c", "m-a"}, ptrs); err != nil {
+		t.Fatalf("Partial hit - %v", err)
+	}
+	if ptrs[0] == nil || ptrs[0].Name != "C" || ptrs[1] == nil || ptrs[1].Name != "A" {
+		t.Errorf("Invalid partial hit - %v %v", ptrs[0], ptrs[1])
+	}
+	if !reflect.DeepEqual(f.datastoreCalls, [][]string{{"c"}}) || !reflect.DeepEqual(f.cached, []string{"m-c"}) {
+		t.Errorf("Invalid calls - %v %v", f.datastoreCalls, f.cached)
+	}
+
+	//Entities missing from datastore are reported in a MultiError
+	dst = make([]cachedEntity, 3)
+	err := GetMultiFromDatastoreSimpleOrMemcache(c, "kind", []string{"b", "missing", "c"}, []string{"m-b", "m-missing", "m-c"}, dst)
+	multi, ok := err.(appengine.MultiError)
+	if !ok || len(multi) != 3 {
+		t.Fatalf("Expected a MultiError - %v", err)
+	}
+	if multi[0] != nil || multi[2] != nil || !errors.Is(multi[1], ErrNotFound) || !errors.Is(multi[1], datastore.ErrNoSuchEntity) {
+		t.Errorf("Invalid MultiError - %v", multi)
+	}
+	if dst[0].Name != "B" || dst[2].Name != "C" {
+		t.Errorf("Found entities not loaded - %v", dst)
+	}
+	sort.Strings(f.cached)
+	if !reflect.DeepEqual(f.cached, []string{"m-c"}) {
+		t.Errorf("Missing entity cached - %v", f.cached)
+	}
+
+	if err := GetMultiFromDatastoreSimpleOrMemcache(c, "kind", []string{"a"}, []string{"m-a", "m-b"}, make([]cachedEntity, 1)); err == nil {
+		t.Errorf("Mismatched lengths accepted")
+	}
+}
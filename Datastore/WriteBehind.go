@@ -0,0 +1,213 @@
+package Datastore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+var ErrQueueClosed = errors.New("write-behind queue closed")
+
+// Maximum number of entities datastore accepts in a single PutMulti
+const MaxPutMultiSize int = 500
+
+// WriteBehindQueue buffers puts of a single kind and writes them to datastore in batches,
+// either when MaxBatch entities are waiting or every FlushInterval.
+// Failed puts are retried up to MaxRetries times before being dropped.
+// The queue doesn't hold on to any request's context - the background flushing runs on
+// context.Background(), and Flush and Close use the caller's. Call Flush(c) at the end
+// of a request or Close(c) on shutdown so nothing is lost.
+type WriteBehindQueue struct {
+	Kind          string
+	MaxBatch      int
+	FlushInterval time.Duration
+	MaxRetries    int
+	RetryDelay    time.Duration
+
+	pending []*writeBehindItem
+	closed  bool
+
+	//Semaphores
+	pendingMutex sync.Mutex
+	flushMutex   sync.Mutex
+	batchFull    chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+type writeBehindItem struct {
+	stringID string
+	variable interface{}
+	attempts int
+}
+
+// Writes the entities, replaced in tests
+var putMulti = datastore.PutMulti
+
+// Creates a queue writing entities of the given kind and starts its background flushing.
+// An interval of 0 disables time based flushing.
+func NewWriteBehindQueue(kind string, maxBatch int, interval time.Duration) *WriteBehindQueue {
+	if maxBatch <= 0 || maxBatch > MaxPutMultiSize {
+		maxBatch = MaxPutMultiSize
+	}
+	q := new(WriteBehindQueue)
+	q.Kind = kind
+	q.MaxBatch = maxBatch
+	q.FlushInterval = interval
+	q.MaxRetries = 3
+	q.RetryDelay = 100 * time.Millisecond
+	q.batchFull = make(chan struct{}, 1)
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+
+	go q.run()
+
+	return q
+}
+
+// Queues the variable to be stored under stringID. An empty stringID lets datastore allocate the ID.
+func (q *WriteBehindQueue) Put(stringID string, variable interface{}) error {
+	q.pendingMutex.Lock()
+	if q.closed {
+		q.pendingMutex.Unlock()
+		return newError("WriteBehindQueue.Put", q.Kind, stringID, ErrQueueClosed)
+	}
+	q.pending = append(q.pending, &writeBehindItem{stringID: stringID, variable: variable})
+	full := len(q.pending) >= q.MaxBatch
+	q.pendingMutex.Unlock()
+
+	if full {
+		select {
+		case q.batchFull <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Number of entities waiting to be written
+func (q *WriteBehindQueue) Len() int {
+	q.pendingMutex.Lock()
+	defer q.pendingMutex.Unlock()
+	return len(q.pending)
+}
+
+// Writes out everything that is queued, retrying failed puts with a growing delay.
+// Returns an error listing the entities that were dropped after MaxRetries attempts.
+func (q *WriteBehindQueue) Flush(c context.Context) error {
+	var dropped []error
+	delay := q.RetryDelay
+	for i := 0; i <= q.MaxRetries; i++ {
+		dropped = append(dropped, q.flushOnce(c)...)
+		if q.Len() == 0 || i == q.MaxRetries {
+			break
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	return errors.Join(dropped...)
+}
+
+// Stops background flushing, flushes what is left and rejects further puts
+func (q *WriteBehindQueue) Close(c context.Context) error {
+	q.pendingMutex.Lock()
+	if q.closed {
+		q.pendingMutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.pendingMutex.Unlock()
+
+	close(q.stop)
+	<-q.done
+	return q.Flush(c)
+}
+
+func (q *WriteBehindQueue) run() {
+	defer close(q.done)
+
+	//Not tied to a request, so it stays valid after the one that created the queue ends
+	c := context.Background()
+	var tick <-chan time.Time
+	if q.FlushInterval > 0 {
+		ticker := time.NewTicker(q.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-tick:
+		case <-q.batchFull:
+		}
+		for _, err := range q.flushOnce(c) {
+			Log.Errorf(c, "WriteBehindQueue - %v", err)
+		}
+	}
+}
+
+// Writes the queued entities once. Failed entities are put back in the queue
+// unless they ran out of retries, in which case their errors are returned.
+func (q *WriteBehindQueue) flushOnce(c context.Context) []error {
+	q.flushMutex.Lock()
+	defer q.flushMutex.Unlock()
+
+	q.pendingMutex.Lock()
+	items := q.pending
+	q.pending = nil
+	q.pendingMutex.Unlock()
+
+	var retry []*writeBehindItem
+	var dropped []error
+	for len(items) > 0 {
+		batch := items
+		if len(batch) > q.MaxBatch {
+			batch = items[:q.MaxBatch]
+		}
+		items = items[len(batch):]
+
+		keys := make([]*datastore.Key, len(batch))
+		values := make([]interface{}, len(batch))
+		for i, item := range batch {
+			keys[i] = datastore.NewKey(c, q.Kind, item.stringID, 0, nil)
+			values[i] = item.variable
+		}
+		_, err := putMulti(c, keys, values)
+		if err == nil {
+			continue
+		}
+		multi, isMulti := err.(appengine.MultiError)
+		for i, item := range batch {
+			itemErr := err
+			if isMulti {
+				itemErr = multi[i]
+			}
+			if itemErr == nil {
+				continue
+			}
+			item.attempts++
+			if item.attempts > q.MaxRetries {
+				dropped = append(dropped, wrapError("WriteBehindQueue.Flush", q.Kind, item.stringID, itemErr))
+				continue
+			}
+			retry = append(retry, item)
+		}
+	}
+
+	if len(retry) > 0 {
+		q.pendingMutex.Lock()
+		q.pending = append(retry, q.pending...)
+		q.pendingMutex.Unlock()
+	}
+	return dropped
+}
@@ -0,0 +1,158 @@
+package Datastore_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+
+	. "github.com/ThePiachu/Go/Datastore"
+)
+
+// Records the batches written instead of sending them to datastore
+type fakePutMulti struct {
+	lock    sync.Mutex
+	batches [][]string
+	//IDs failing their next put
+	failing map[string]bool
+	written chan struct{}
+}
+
+func newFakePutMulti(t *testing.T) *fakePutMulti {
+	//Keys are made without an App Engine context
+	t.Setenv("GAE_APPLICATION", "s~test")
+	return &fakePutMulti{failing: map[string]bool{}, written: make(chan struct{}, 100)}
+}
+
+func (f *fakePutMulti) put(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	batch := []string{}
+	multi := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if f.failing[key.StringID()] {
+			delete(f.failing, key.StringID())
+			multi[i] = errors.New("write failed")
+			failed = true
+			continue
+		}
+		batch = append(batch, key.StringID())
+	}
+	f.batches = append(f.batches, batch)
+	f.written <- struct{}{}
+	if failed {
+		return nil, multi
+	}
+	return keys, nil
+}
+
+func (f *fakePutMulti) Batches() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([][]string{}, f.batches...)
+}
+
+func (f *fakePutMulti) waitForWrite(t *testing.T) {
+	t.Helper()
+	select {
+	case <-f.written:
+	case <-time.After(time.Second):
+		t.Fatalf("Nothing written")
+	}
+}
+
+func TestWriteBehindQueueBatching(t *testing.T) {
+	fake := newFakePutMulti(t)
+	defer SetPutMulti(fake.put)()
+
+	q := NewWriteBehindQueue("kind", 3, 0)
+	q.RetryDelay = time.Millisecond
+	fake.failing["e"] = true
+	//The first three fill a batch and are written in the background
+	for _, id := range []string{"a", "b", "c"} {
+		q.Put(id, &struct{ A int }{1})
+	}
+	fake.waitForWrite(t)
+	for _, id := range []string{"d", "e", "f", "g"} {
+		q.Put(id, &struct{ A int }{1})
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Errorf("Close - %v", err)
+	}
+
+	written := map[string]int{}
+	for _, batch := range fake.Batches() {
+		if len(batch) > 3 {
+			t.Errorf("Batch larger than MaxBatch - %v", batch)
+		}
+		for _, id := range batch {
+			written[id]++
+		}
+	}
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		if written[id] != 1 {
+			t.Errorf("%v written %v times - %v", id, written[id], fake.Batches())
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Entities left in the queue - %v", q.Len())
+	}
+	if err := q.Put("h", &struct{ A int }{1}); !errors.Is(err, ErrQueueClosed) {
+		t.Errorf("Put on a closed queue - %v", err)
+	}
+}
+
+func TestWriteBehindQueueFlushOnInterval(t *testing.T) {
+	fake := newFakePutMulti(t)
+	defer SetPutMulti(fake.put)()
+
+	q := NewWriteBehindQueue("kind", 100, 10*time.Millisecond)
+	defer q.Close(context.Background())
+	q.Put("a", &struct{ A int }{1})
+	fake.waitForWrite(t)
+	if batches := fake.Batches(); len(batches) != 1 || len(batches[0]) != 1 || batches[0][0] != "a" {
+		t.Errorf("Invalid batches - %v", batches)
+	}
+}
+
+func TestWriteBehindQueueDropsAfterRetries(t *testing.T) {
+	fake := newFakePutMulti(t)
+	defer SetPutMulti(fake.put)()
+
+	q := NewWriteBehindQueue("kind", 10, 0)
+	q.MaxRetries = 1
+	q.RetryDelay = time.Millisecond
+	q.Put("a", &struct{ A int }{1})
+	fake.lock.Lock()
+	fake.failing["a"] = true
+	fake.lock.Unlock()
+	//Fails once, then succeeds on the retry
+	if err := q.Flush(context.Background()); err != nil {
+		t.Errorf("Flush - %v", err)
+	}
+
+	failing := &alwaysFailing{}
+	defer SetPutMulti(failing.put)()
+	q.Put("b", &struct{ A int }{1})
+	if err := q.Close(context.Background()); err == nil || q.Len() != 0 || failing.calls != 2 {
+		t.Errorf("Entity not dropped after retries - %v %v %v", err, q.Len(), failing.calls)
+	}
+}
+
+type alwaysFailing struct {
+	calls int
+}
+
+func (f *alwaysFailing) put(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	f.calls++
+	return nil, errors.New("datastore down")
+}
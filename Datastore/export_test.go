@@ -0,0 +1,71 @@
+package Datastore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/memcache"
+)
+
+// Unexported helpers used by the tests in Datastore_test
+var WrapError = wrapError
+
+// Replaces the datastore writes of the write-behind queues, returning a function restoring them
+func SetPutMulti(f func(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error)) func() {
+	old := putMulti
+	putMulti = f
+	return func() { putMulti = old }
+}
+
+// Replaces the memcache and datastore calls of GetMultiFromDatastoreSimpleOrMemcache,
+// returning a function restoring them
+func SetGetMultiCalls(get func(c context.Context, keys []string) (map[string]*memcache.Item, error),
+	set func(c context.Context, items []*memcache.Item) error,
+	datastoreGet func(c context.Context, keys []*datastore.Key, dst interface{}) error) func() {
+	oldGet, oldSet, oldDatastoreGet := memcacheGetMulti, memcacheSetMulti, datastoreGetMulti
+	memcacheGetMulti, memcacheSetMulti, datastoreGetMulti = get, set, datastoreGet
+	return func() {
+		memcacheGetMulti, memcacheSetMulti, datastoreGetMulti = oldGet, oldSet, oldDatastoreGet
+	}
+}
+
+// Replaces the capability checks, returning a function restoring them. The cached
+// service status is cleared.
+func SetCapabilityEnabled(f func(c context.Context, api, capability string) bool) func() {
+	old := capabilityEnabled
+	capabilityEnabled = f
+	serviceStatus.Lock()
+	serviceStatus.status = ServiceStatus{}
+	serviceStatus.Unlock()
+	return func() {
+		capabilityEnabled = old
+		serviceStatus.Lock()
+		serviceStatus.status = ServiceStatus{}
+		serviceStatus.Unlock()
+	}
+}
+
+// Encodes the properties as a queued write would be, through gob, and decodes them back
+func RoundTripQueuedWrite(key *datastore.Key, props datastore.PropertyList) (*datastore.Key, datastore.PropertyList, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(queuedWrite{Key: key.Encode(), Version: newWriteVersion(), Properties: encodeProperties(props)})
+	if err != nil {
+		return nil, nil, err
+	}
+	w := queuedWrite{}
+	if err := gob.NewDecoder(&b).Decode(&w); err != nil {
+		return nil, nil, err
+	}
+	decodedKey, err := datastore.DecodeKey(w.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	decoded, err := decodeProperties(w.Properties)
+	return decodedKey, decoded, err
+}
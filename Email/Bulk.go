@@ -0,0 +1,183 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"github.com/ThePiachu/Go/mymath"
+	"golang.org/x/net/context"
+)
+
+// Bulk sending. Every recipient gets their own message, rendered from their own data,
+// with only their address in it. Sending is throttled to the configured rate:
+//
+//	report := Email.SendBulk(c, recipients, func(r Email.BulkRecipient) (*Email.Message, error) {
+//		return templates.NewMessage(r.Locale, "newsletter", r.Data)
+//	}, Email.BulkOptions{Sender: "news@example.com", Rate: 10})
+
+const (
+	BulkSent      = "sent"
+	BulkQueued    = "queued"
+	BulkInvalid   = "invalid"
+	BulkDuplicate = "duplicate"
+	BulkFailed    = "failed"
+	BulkSkipped   = "skipped"
+	//The address is on the suppression list
+	BulkSuppressed = "suppressed"
+)
+
+var ErrInvalidAddress = mymath.ErrInvalidEmailAddress
+
+type BulkRecipient struct {
+	Address string
+	Name    string
+	Locale  string
+	Data    interface{}
+}
+
+type BulkOptions struct {
+	Sender string
+	//Messages per second, unlimited if 0
+	Rate float64
+	//With a batch ID the messages are put in the outbox with BatchID + ":" + address as the
+	//idempotency key instead of being sent directly, so repeating a batch doesn't send twice
+	BatchID string
+}
+
+type BulkResult struct {
+	Address string
+	Status  string
+	Error   error
+}
+
+type BulkReport struct {
+	Results []BulkResult
+	Counts  map[string]int
+}
+
+func (r *BulkReport) add(address, status string, err error) {
+	r.Results = append(r.Results, BulkResult{Address: address, Status: status, Error: err})
+	r.Counts[status]++
+}
+
+// Returns the results with the given status
+func (r *BulkReport) WithStatus(status string) []BulkResult {
+	answer := []BulkResult{}
+	for _, result := range r.Results {
+		if result.Status == status {
+			answer = append(answer, result)
+		}
+	}
+	return answer
+}
+
+// Renders and sends a message to every recipient, reporting what happened to each.
+// Invalid, repeated and suppressed addresses are skipped; sending stops when c is cancelled.
+// The messages get List-Unsubscribe headers if unsubscribe links are configured.
+// render can return a nil message to skip a recipient.
+func SendBulk(c context.Context, recipients []BulkRecipient, render func(BulkRecipient) (*Message, error), options BulkOptions) *BulkReport {
+	report := &BulkReport{Counts: map[string]int{}}
+	seen := map[string]bool{}
+	var interval time.Duration
+	if options.Rate > 0 {
+		interval = time.Duration(float64(time.Second) / options.Rate)
+	}
+	var last time.Time
+
+	for i, recipient := range recipients {
+		address, err := mymath.ParseEmailAddress(recipient.Address)
+		if err != nil {
+			report.add(recipient.Address, BulkInvalid, err)
+			continue
+		}
+		normalized := address.Normalized()
+		if seen[normalized] {
+			report.add(recipient.Address, BulkDuplicate, nil)
+			continue
+		}
+		seen[normalized] = true
+
+		if err := c.Err(); err != nil {
+			for _, skipped := range recipients[i:] {
+				report.add(skipped.Address, BulkSkipped, err)
+			}
+			break
+		}
+
+		suppression, err := IsSuppressed(c, normalized)
+		if err != nil {
+			report.add(recipient.Address, BulkFailed, err)
+			continue
+		}
+		if suppression != nil {
+			report.add(recipient.Address, BulkSuppressed, nil)
+			continue
+		}
+
+		msg, err := render(recipient)
+		if err != nil {
+			report.add(recipient.Address, BulkFailed, err)
+			continue
+		}
+		if msg == nil {
+			report.add(recipient.Address, BulkSkipped, nil)
+			continue
+		}
+		msg.Sender = options.Sender
+		if recipient.Name != "" {
+			address.Name = recipient.Name
+		}
+		msg.To = []string{address.String()}
+		msg.Cc, msg.Bcc = nil, nil
+		if len(UnsubscribeConfig.Secret) > 0 && UnsubscribeConfig.URL != "" && msg.Headers.Get("List-Unsubscribe") == "" {
+			if err := msg.SetUnsubscribeHeaders(); err != nil {
+				report.add(recipient.Address, BulkFailed, err)
+				continue
+			}
+		}
+
+		//Throttled right before the send, so skipped recipients don't use up the rate
+		if wait := interval - time.Since(last); interval > 0 && !last.IsZero() && wait > 0 {
+			select {
+			case <-c.Done():
+			case <-time.After(wait):
+			}
+		}
+		if err := c.Err(); err != nil {
+			for _, skipped := range recipients[i:] {
+				report.add(skipped.Address, BulkSkipped, err)
+			}
+			break
+		}
+		last = time.Now()
+
+		if options.BatchID != "" {
+			_, err = EnqueueInOutbox(c, options.BatchID+":"+normalized, msg)
+			if err != nil {
+				report.add(recipient.Address, BulkFailed, err)
+				continue
+			}
+			report.add(recipient.Address, BulkQueued, nil)
+			continue
+		}
+		//Already checked against the suppression list
+		if err := GetTransport().Send(c, msg); err != nil {
+			Log.Warningf(c, "SendBulk - %v - %v", normalized, err)
+			report.add(recipient.Address, BulkFailed, err)
+			continue
+		}
+		report.add(recipient.Address, BulkSent, nil)
+	}
+	return report
+}
+
+// Sends the templated mail to every recipient, in the recipient's locale
+func SendBulkTemplatedEmail(c context.Context, templates *TemplateSet, name string, recipients []BulkRecipient, options BulkOptions) *BulkReport {
+	return SendBulk(c, recipients, func(r BulkRecipient) (*Message, error) {
+		return templates.NewMessage(r.Locale, name, r.Data)
+	}, options)
+}
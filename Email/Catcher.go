@@ -0,0 +1,323 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"github.com/ThePiachu/Go/web"
+	"golang.org/x/net/context"
+)
+
+// Catching mail instead of sending it, for tests and development:
+//
+//	catcher := Email.NewCatcherTransport(100)
+//	Email.SetTransport(catcher)
+//	SignUp(c, "ann@example.org")
+//	catcher.AssertSent(t, Email.SentTo("ann@example.org"), Email.SubjectContains("Welcome"))
+//
+// With MAIL_TRANSPORT=memory the caught mail can be browsed with MountInbox.
+
+type CaughtMessage struct {
+	ID      int
+	Time    time.Time
+	Message *Message
+	//The message as it would have been sent
+	Raw []byte
+}
+
+type CatcherTransport struct {
+	lock     sync.RWMutex
+	messages []*CaughtMessage
+	limit    int
+	nextID   int
+}
+
+// Keeps the last limit messages
+func NewCatcherTransport(limit int) *CatcherTransport {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &CatcherTransport{limit: limit, nextID: 1}
+}
+
+func (t *CatcherTransport) Send(c context.Context, msg *Message) error {
+	raw, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	copied := *msg
+	copied.To = append([]string{}, msg.To...)
+	copied.Cc = append([]string{}, msg.Cc...)
+	copied.Bcc = append([]string{}, msg.Bcc...)
+	copied.Attachments = append([]Attachment{}, msg.Attachments...)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.messages = append(t.messages, &CaughtMessage{ID: t.nextID, Time: time.Now(), Message: &copied, Raw: raw})
+	t.nextID++
+	if len(t.messages) > t.limit {
+		t.messages = t.messages[len(t.messages)-t.limit:]
+	}
+	return nil
+}
+
+// Returns the caught messages, oldest first
+func (t *CatcherTransport) Messages() []*CaughtMessage {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return append([]*CaughtMessage{}, t.messages...)
+}
+
+func (t *CatcherTransport) Get(id int) *CaughtMessage {
+	for _, m := range t.Messages() {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Returns the last caught message, or nil
+func (t *CatcherTransport) Last() *Message {
+	messages := t.Messages()
+	if len(messages) == 0 {
+		return nil
+	}
+	return messages[len(messages)-1].Message
+}
+
+func (t *CatcherTransport) Reset() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.messages = nil
+}
+
+// Selects messages
+type MessageMatcher func(*Message) bool
+
+// Matches messages delivered to the address, whether in To, Cc or Bcc
+func SentTo(address string) MessageMatcher {
+	return func(m *Message) bool {
+		recipients, err := m.EnvelopeRecipients()
+		if err != nil {
+			return false
+		}
+		for _, r := range recipients {
+			if strings.EqualFold(r, address) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func SentFrom(address string) MessageMatcher {
+	return func(m *Message) bool {
+		sender, err := m.EnvelopeSender()
+		return err == nil && strings.EqualFold(sender, address)
+	}
+}
+
+func SubjectContains(s string) MessageMatcher {
+	return func(m *Message) bool {
+		return strings.Contains(m.Subject, s)
+	}
+}
+
+// Matches messages whose text or HTML body contains s
+func BodyContains(s string) MessageMatcher {
+	return func(m *Message) bool {
+		return strings.Contains(m.Body, s) || strings.Contains(m.HTMLBody, s)
+	}
+}
+
+func HasAttachment(name string) MessageMatcher {
+	return func(m *Message) bool {
+		for _, a := range m.Attachments {
+			if a.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Returns the caught messages matching all the matchers
+func (t *CatcherTransport) Find(matchers ...MessageMatcher) []*Message {
+	answer := []*Message{}
+	for _, caught := range t.Messages() {
+		matches := true
+		for _, m := range matchers {
+			matches = matches && m(caught.Message)
+		}
+		if matches {
+			answer = append(answer, caught.Message)
+		}
+	}
+	return answer
+}
+
+func (t *CatcherTransport) Count(matchers ...MessageMatcher) int {
+	return len(t.Find(matchers...))
+}
+
+func (t *CatcherTransport) String() string {
+	var b strings.Builder
+	for _, caught := range t.Messages() {
+		b.WriteString(strings.Join(caught.Message.Recipients(), ", "))
+		b.WriteString(" - ")
+		b.WriteString(caught.Message.Subject)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func (t *CatcherTransport) AssertSent(tt Log.TestingT, matchers ...MessageMatcher) {
+	tt.Helper()
+	if t.Count(matchers...) == 0 {
+		tt.Errorf("Expected email not sent. Caught:\n%s", t)
+	}
+}
+
+func (t *CatcherTransport) AssertNotSent(tt Log.TestingT, matchers ...MessageMatcher) {
+	tt.Helper()
+	if found := t.Find(matchers...); len(found) > 0 {
+		tt.Errorf("Unexpected email sent to %v - %v", found[0].Recipients(), found[0].Subject)
+	}
+}
+
+func (t *CatcherTransport) AssertCount(tt Log.TestingT, count int, matchers ...MessageMatcher) {
+	tt.Helper()
+	if n := t.Count(matchers...); n != count {
+		tt.Errorf("Expected %v matching emails, found %v. Caught:\n%s", count, n, t)
+	}
+}
+
+// Mounts the inbox of the active transport at path on web.Mux, if it is a catcher.
+// Meant for development only - anyone reaching it can read the caught mail.
+func MountInbox(path string) {
+	if catcher, ok := GetTransport().(*CatcherTransport); ok {
+		web.Mux.Handle(path, catcher)
+	}
+}
+
+var inboxTemplate = template.Must(template.New("inbox").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("15:04:05") },
+	"join": func(list []string) string { return strings.Join(list, ", ") },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Inbox</title>
+<style>
+body{font-family:sans-serif;font-size:14px}
+table{border-collapse:collapse;width:100%}
+td,th{border-bottom:1px solid #ddd;padding:4px 8px;text-align:left}
+iframe{width:100%;height:600px;border:1px solid #ddd}
+pre{white-space:pre-wrap}
+</style></head><body>
+{{if .Message}}{{with .Message}}
+<p><a href="?">Inbox</a> | <a href="?id={{.ID}}&amp;raw=1">Source</a></p>
+<table>
+<tr><th>From</th><td>{{.Message.Sender}}</td></tr>
+{{if .Message.ReplyTo}}<tr><th>Reply-To</th><td>{{.Message.ReplyTo}}</td></tr>{{end}}
+<tr><th>To</th><td>{{join .Message.To}}</td></tr>
+{{if .Message.Cc}}<tr><th>Cc</th><td>{{join .Message.Cc}}</td></tr>{{end}}
+{{if .Message.Bcc}}<tr><th>Bcc</th><td>{{join .Message.Bcc}}</td></tr>{{end}}
+<tr><th>Subject</th><td>{{.Message.Subject}}</td></tr>
+{{range $i, $a := .Message.Attachments}}<tr><th>{{if $a.ContentID}}Inline{{else}}Attachment{{end}}</th>
+<td><a href="?id={{$.Message.ID}}&amp;attachment={{$i}}">{{$a.Name}}</a> ({{len $a.Data}} bytes)</td></tr>{{end}}
+</table>
+{{if .Message.HTMLBody}}<h3>HTML</h3><iframe sandbox src="?id={{.ID}}&amp;html=1"></iframe>{{end}}
+{{if .Message.Body}}<h3>Text</h3><pre>{{.Message.Body}}</pre>{{end}}
+{{end}}{{else}}
+<form method="post"><input type="submit" value="Clear"></form>
+<table>
+<tr><th>Time</th><th>From</th><th>To</th><th>Subject</th></tr>
+{{range .Messages}}<tr><td>{{time .Time}}</td><td>{{.Message.Sender}}</td><td>{{join .Message.Recipients}}</td>
+<td><a href="?id={{.ID}}">{{.Message.Subject}}</a></td></tr>
+{{else}}<tr><td colspan="4">No mail</td></tr>{{end}}
+</table>
+{{end}}
+</body></html>
+`))
+
+// Serves the inbox: the list of caught messages, and for ?id= the message with its HTML
+// body, attachments and source. POST clears the inbox.
+func (t *CatcherTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		t.Reset()
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return
+	}
+	page := struct {
+		Messages []*CaughtMessage
+		Message  *CaughtMessage
+	}{}
+	if id := r.FormValue("id"); id != "" {
+		n, _ := strconv.Atoi(id)
+		page.Message = t.Get(n)
+		if page.Message == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if t.serveMessagePart(w, r, page.Message) {
+			return
+		}
+	} else {
+		messages := t.Messages()
+		for i := len(messages) - 1; i >= 0; i-- {
+			page.Messages = append(page.Messages, messages[i])
+		}
+	}
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := inboxTemplate.Execute(w, page); err != nil {
+		Log.Errorf(r.Context(), "CatcherTransport.ServeHTTP - %v", err)
+	}
+}
+
+// Serves the HTML body, an attachment or the source if requested
+func (t *CatcherTransport) serveMessagePart(w http.ResponseWriter, r *http.Request, caught *CaughtMessage) bool {
+	msg := caught.Message
+	switch {
+	case r.FormValue("raw") != "":
+		w.Header().Set("Content-type", "text/plain; charset=utf-8")
+		w.Write(caught.Raw)
+	case r.FormValue("html") != "":
+		//Inline images are served by the inbox
+		body := msg.HTMLBody
+		for i, a := range msg.Attachments {
+			if a.ContentID != "" {
+				body = strings.ReplaceAll(body, "cid:"+a.ContentID, "?id="+strconv.Itoa(caught.ID)+"&attachment="+strconv.Itoa(i))
+			}
+		}
+		w.Header().Set("Content-type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Write([]byte(body))
+	case r.FormValue("attachment") != "":
+		i, err := strconv.Atoi(r.FormValue("attachment"))
+		if err != nil || i < 0 || i >= len(msg.Attachments) {
+			http.NotFound(w, r)
+			return true
+		}
+		a := msg.Attachments[i]
+		//Attachments come from whoever sent the mail, so they can't run scripts on the inbox
+		w.Header().Set("Content-type", a.contentType())
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if a.ContentID == "" {
+			w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(a.Name))
+		}
+		w.Write(a.Data)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,427 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM signing (RFC 6376) with rsa-sha256 or ed25519-sha256 (RFC 8463) keys and
+// relaxed/relaxed canonicalization. The SMTP transport signs the mail it sends when its
+// DKIM field is set; from the environment:
+//
+//	MAIL_DKIM_DOMAIN=example.com
+//	MAIL_DKIM_SELECTOR=mail
+//	MAIL_DKIM_KEY_FILE=/secrets/dkim.pem
+//
+// The public key is published as a TXT record at mail._domainkey.example.com.
+
+// Header fields signed when present
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id", "In-Reply-To", "References",
+	"Mime-Version", "Content-Type", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+var ErrDKIMNoSignature = errors.New("no DKIM signature")
+var ErrDKIMInvalidSignature = errors.New("invalid DKIM signature")
+
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	//An *rsa.PrivateKey or an ed25519.PrivateKey
+	Key     crypto.Signer
+	Headers []string
+}
+
+// Creates a signer from a PEM encoded PKCS #1 or PKCS #8 private key
+func NewDKIMSigner(domain, selector string, pemKey []byte) (*DKIMSigner, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, Key: key.(crypto.Signer), Headers: DefaultDKIMHeaders}, nil
+	}
+	return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+}
+
+// Creates the signer from the MAIL_DKIM_* environment variables, or returns nil if they aren't set
+func DKIMSignerFromEnv() (*DKIMSigner, error) {
+	domain, selector, keyFile := os.Getenv("MAIL_DKIM_DOMAIN"), os.Getenv("MAIL_DKIM_SELECTOR"), os.Getenv("MAIL_DKIM_KEY_FILE")
+	if domain == "" && selector == "" && keyFile == "" {
+		return nil, nil
+	}
+	if domain == "" || selector == "" || keyFile == "" {
+		return nil, errors.New("MAIL_DKIM_DOMAIN, MAIL_DKIM_SELECTOR and MAIL_DKIM_KEY_FILE must be set together")
+	}
+	pemKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewDKIMSigner(domain, selector, pemKey)
+}
+
+// Returns the TXT record to publish for the signer's key
+func (s *DKIMSigner) DNSRecord() (string, error) {
+	switch key := s.Key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	}
+	return "", fmt.Errorf("unsupported DKIM key type %T", s.Key)
+}
+
+func (s *DKIMSigner) algorithm() (string, crypto.SignerOpts, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		//The SHA-256 hash of the header is signed with PureEdDSA
+		return "ed25519-sha256", crypto.Hash(0), nil
+	}
+	return "", nil, fmt.Errorf("unsupported DKIM key type %T", s.Key)
+}
+
+// A header field as it appears in the message, with its folding
+type headerField struct {
+	name string
+	raw  string
+}
+
+// Splits a CRLF message into its header fields and body
+func splitMessage(message []byte) ([]headerField, []byte) {
+	header, body := message, []byte{}
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		header, body = message[:i+2], message[i+4:]
+	}
+	fields := []headerField{}
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name := line
+		if i := strings.Index(line, ":"); i >= 0 {
+			name = line[:i]
+		}
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields, body
+}
+
+// Collapses the runs of whitespace to a single space, dropping the leading and trailing ones
+func compressWhitespace(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == '\t' }), " ")
+}
+
+// Relaxed header canonicalization, including the CRLF
+func relaxedHeader(raw string) string {
+	i := strings.Index(raw, ":")
+	if i < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimSpace(raw[:i]))
+	value := strings.NewReplacer("\r\n", "").Replace(raw[i+1:])
+	return name + ":" + compressWhitespace(value) + "\r\n"
+}
+
+// Collapses the runs of whitespace in a body line to a single space and drops the
+// trailing ones. Unlike in headers, leading whitespace is kept.
+func relaxedBodyLine(line string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(line); i++ {
+		if line[i] == ' ' || line[i] == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(line[i])
+	}
+	return b.String()
+}
+
+// Relaxed body canonicalization
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = relaxedBodyLine(line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// Simple body canonicalization, used when verifying
+func simpleBody(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n\r\n")) {
+		body = body[:len(body)-2]
+	}
+	if !bytes.HasSuffix(body, []byte("\r\n")) {
+		body = append(append([]byte{}, body...), "\r\n"...)
+	}
+	return body
+}
+
+// Picks the fields to sign, the last occurrence first as RFC 6376 requires
+func selectHeaders(fields []headerField, names []string) []headerField {
+	used := map[int]bool{}
+	answer := []headerField{}
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				answer = append(answer, fields[i])
+				break
+			}
+		}
+	}
+	return answer
+}
+
+// Returns the message with a DKIM-Signature header field prepended
+func (s *DKIMSigner) Sign(message []byte) ([]byte, error) {
+	algorithm, opts, err := s.algorithm()
+	if err != nil {
+		return nil, err
+	}
+	headers := s.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	fields, body := splitMessage(message)
+	signed := selectHeaders(fields, headers)
+	names := []string{}
+	for _, f := range signed {
+		names = append(names, strings.ToLower(f.name))
+	}
+
+	bodyHash := sha256.Sum256(relaxedBody(body))
+	signature := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, s.Domain, s.Selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	for _, f := range signed {
+		h.Write([]byte(relaxedHeader(f.raw)))
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader(signature), "\r\n")))
+	sig, err := s.Key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return nil, err
+	}
+	signature += base64.StdEncoding.EncodeToString(sig) + "\r\n"
+	return append([]byte(signature), message...), nil
+}
+
+// Looks up the TXT record of a DKIM key
+type DKIMKeyLookup func(domain, selector string) (string, error)
+
+func LookupDKIMKey(domain, selector string) (string, error) {
+	records, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return "", err
+	}
+	if len(records) == 0 {
+		return "", errors.New("no DKIM key record for " + selector + "._domainkey." + domain)
+	}
+	return records[0], nil
+}
+
+// Parses "tag=value; tag=value" lists of DKIM signatures and key records
+func parseDKIMTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.Join(strings.Fields(kv[1]), "")
+	}
+	return tags
+}
+
+func parseDKIMPublicKey(record string) (crypto.PublicKey, error) {
+	tags := parseDKIMTags(record)
+	data, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid DKIM key record")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(data)
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 DKIM key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, errors.New("unsupported DKIM key type " + tags["k"])
+}
+
+// Verifies the DKIM signatures of a message, looking the keys up in DNS.
+// Returns the domain of the first valid signature.
+func VerifyDKIM(message []byte) (string, error) {
+	return VerifyDKIMWithLookup(message, LookupDKIMKey)
+}
+
+// Verifies the DKIM signatures of a message with keys from lookup, so that tests
+// don't need DNS. Returns the domain of the first valid signature.
+func VerifyDKIMWithLookup(message []byte, lookup DKIMKeyLookup) (string, error) {
+	if !bytes.Contains(message, []byte("\r\n")) {
+		message = bytes.ReplaceAll(message, []byte("\n"), []byte("\r\n"))
+	}
+	fields, body := splitMessage(message)
+	err := ErrDKIMNoSignature
+	for i, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		var domain string
+		domain, err = verifyDKIMSignature(fields[i], fields, body, lookup)
+		if err == nil {
+			return domain, nil
+		}
+	}
+	return "", err
+}
+
+// Removes the value of the b= tag from a DKIM-Signature field
+func stripDKIMSignatureValue(raw string) string {
+	pos := strings.Index(raw, ":") + 1
+	for _, part := range strings.SplitAfter(raw[pos:], ";") {
+		eq := strings.Index(part, "=")
+		if eq >= 0 && strings.TrimSpace(part[:eq]) == "b" {
+			end := len(strings.TrimRight(part, "\r\n"))
+			if strings.HasSuffix(part, ";") {
+				end = len(part) - 1
+			}
+			return raw[:pos+eq+1] + raw[pos+end:]
+		}
+		pos += len(part)
+	}
+	return raw
+}
+
+func verifyDKIMSignature(signature headerField, fields []headerField, body []byte, lookup DKIMKeyLookup) (string, error) {
+	tags := parseDKIMTags(signature.raw[strings.Index(signature.raw, ":")+1:])
+	if tags["v"] != "1" || tags["d"] == "" || tags["s"] == "" {
+		return "", fmt.Errorf("%w - missing tags", ErrDKIMInvalidSignature)
+	}
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := tags["c"]; c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+
+	canonicalBody := simpleBody(body)
+	if bodyCanon == "relaxed" {
+		canonicalBody = relaxedBody(body)
+	}
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n > len(canonicalBody) {
+			return "", fmt.Errorf("%w - invalid body length", ErrDKIMInvalidSignature)
+		}
+		canonicalBody = canonicalBody[:n]
+	}
+	bodyHash := sha256.Sum256(canonicalBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return "", fmt.Errorf("%w - body hash mismatch", ErrDKIMInvalidSignature)
+	}
+
+	canonicalHeader := func(raw string) string {
+		if headerCanon == "relaxed" {
+			return relaxedHeader(raw)
+		}
+		return raw
+	}
+	h := sha256.New()
+	for _, f := range selectHeaders(fields, strings.Split(tags["h"], ":")) {
+		h.Write([]byte(canonicalHeader(f.raw)))
+	}
+	//The signature field itself, with the value of b= removed
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(stripDKIMSignatureValue(signature.raw)), "\r\n")))
+	digest := h.Sum(nil)
+
+	record, err := lookup(tags["d"], tags["s"])
+	if err != nil {
+		return "", err
+	}
+	key, err := parseDKIMPublicKey(record)
+	if err != nil {
+		return "", err
+	}
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return "", fmt.Errorf("%w - %v", ErrDKIMInvalidSignature, err)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return "", fmt.Errorf("%w - algorithm %v doesn't match the key", ErrDKIMInvalidSignature, tags["a"])
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig); err != nil {
+			return "", fmt.Errorf("%w - %v", ErrDKIMInvalidSignature, err)
+		}
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return "", fmt.Errorf("%w - algorithm %v doesn't match the key", ErrDKIMInvalidSignature, tags["a"])
+		}
+		if !ed25519.Verify(key, digest, sig) {
+			return "", ErrDKIMInvalidSignature
+		}
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+	return tags["d"], nil
+}
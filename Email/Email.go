@@ -7,17 +7,26 @@ package Email
 import (
 	"github.com/ThePiachu/Go/Log"
 	"golang.org/x/net/context"
-	"google.golang.org/appengine/v2/mail"
 )
 
+// Sends the message through the active transport, skipping suppressed recipients
+func Send(c context.Context, msg *Message) error {
+	err := deliver(c, msg)
+	if err != nil {
+		Log.Errorf(c, "Send - %v", err)
+		return err
+	}
+	return nil
+}
+
 func SendHTMLEmail(c context.Context, subject string, to []string, sender string, mailBody string) error {
-	msg := &mail.Message{
+	msg := &Message{
 		Sender:   sender,
 		To:       to,
 		Subject:  subject,
 		HTMLBody: mailBody,
 	}
-	err := mail.Send(c, msg)
+	err := deliver(c, msg)
 	if err != nil {
 		Log.Errorf(c, "SendHTMLEmail - %v", err)
 		return err
@@ -26,15 +35,15 @@ func SendHTMLEmail(c context.Context, subject string, to []string, sender string
 }
 
 func SendEmail(c context.Context, subject string, to []string, sender string, mailBody string) error {
-	msg := &mail.Message{
+	msg := &Message{
 		Sender:  sender,
 		To:      to,
 		Subject: subject,
 		Body:    mailBody,
 	}
-	err := mail.Send(c, msg)
+	err := deliver(c, msg)
 	if err != nil {
-		Log.Errorf(c, "Email - SendHTMLEmail - %v", err)
+		Log.Errorf(c, "SendEmail - %v", err)
 		return err
 	}
 	return nil
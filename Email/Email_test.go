@@ -0,0 +1,728 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func testMessage() *Message {
+	return &Message{
+		Sender:   "App <app@example.com>",
+		To:       []string{"Zoë <zoe@example.org>", "bob@example.org"},
+		Subject:  "Zażółć",
+		Body:     "Hello\nFrom the app",
+		HTMLBody: "<p>Hello</p>",
+	}
+}
+
+func TestMessageBytes(t *testing.T) {
+	data, err := testMessage().Bytes()
+	if err != nil {
+		t.Fatalf("Bytes - %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadMessage - %v", err)
+	}
+	to, err := parsed.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[0].Name != "Zoë" {
+		t.Errorf("Invalid To - %v %v", to, err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if subject != "Zażółć" {
+		t.Errorf("Invalid Subject - %v", subject)
+	}
+	if !strings.HasPrefix(parsed.Header.Get("Content-Type"), "multipart/alternative; boundary=") {
+		t.Errorf("Invalid Content-Type - %v", parsed.Header.Get("Content-Type"))
+	}
+
+	if _, err := (&Message{Sender: "app@example.com", Body: "x"}).Bytes(); err != ErrNoRecipients {
+		t.Errorf("Message without recipients accepted - %v", err)
+	}
+}
+
+func TestSpoolTransports(t *testing.T) {
+	dir := t.TempDir()
+	c := context.Background()
+
+	maildir := NewMaildirTransport(filepath.Join(dir, "maildir"))
+	if err := maildir.Send(c, testMessage()); err != nil {
+		t.Fatalf("Maildir - %v", err)
+	}
+	files, _ := os.ReadDir(filepath.Join(dir, "maildir", "new"))
+	if len(files) != 1 {
+		t.Errorf("Expected 1 message in maildir, got %v", len(files))
+	}
+
+	mbox := NewMboxTransport(filepath.Join(dir, "mail.mbox"))
+	msg := testMessage()
+	msg.HTMLBody = ""
+	msg.Body = "From here\n>From there"
+	for i := 0; i < 2; i++ {
+		if err := mbox.Send(c, msg); err != nil {
+			t.Fatalf("Mbox - %v", err)
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "mail.mbox"))
+	if strings.Count(string(data), "\nFrom app@example.com ") != 1 || !strings.HasPrefix(string(data), "From app@example.com ") {
+		t.Errorf("Invalid mbox separators - %s", data)
+	}
+	if !strings.Contains(string(data), "\n>From here\n>>From there\n") {
+		t.Errorf("From lines not escaped - %s", data)
+	}
+}
+
+// Accepts a single message, recording the commands and the data
+func fakeSMTPServer(l net.Listener, commands *[]string, data *bytes.Buffer) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "220 localhost ESMTP\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		*commands = append(*commands, line)
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			io.WriteString(conn, "250-localhost\r\n250 8BITMIME\r\n")
+		case line == "DATA":
+			io.WriteString(conn, "354 go ahead\r\n")
+			for {
+				dataLine, err := r.ReadString('\n')
+				if err != nil || dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			io.WriteString(conn, "250 queued\r\n")
+		case line == "QUIT":
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSMTPTransport(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Listen - %v", err)
+	}
+	defer l.Close()
+	commands := []string{}
+	data := new(bytes.Buffer)
+	done := make(chan bool)
+	go func() {
+		fakeSMTPServer(l, &commands, data)
+		close(done)
+	}()
+
+	transport, err := ParseTransport("smtp://" + l.Addr().String() + "?starttls=required")
+	if err != nil {
+		t.Fatalf("ParseTransport - %v", err)
+	}
+	if err := transport.Send(context.Background(), testMessage()); err != ErrStartTLSNotSupported {
+		t.Errorf("Sent without STARTTLS - %v", err)
+	}
+	<-done
+
+	done = make(chan bool)
+	commands = []string{}
+	go func() {
+		fakeSMTPServer(l, &commands, data)
+		close(done)
+	}()
+	transport.(*SMTPTransport).StartTLS = StartTLSOpportunistic
+	if err := transport.Send(context.Background(), testMessage()); err != nil {
+		t.Fatalf("Send - %v", err)
+	}
+	<-done
+	expected := []string{"MAIL FROM:<app@example.com>", "RCPT TO:<zoe@example.org>", "RCPT TO:<bob@example.org>", "DATA"}
+	for _, command := range expected {
+		found := false
+		for _, c := range commands {
+			found = found || strings.HasPrefix(c, command)
+		}
+		if !found {
+			t.Errorf("Command %v not sent - %v", command, commands)
+		}
+	}
+	if !strings.Contains(data.String(), "Subject: =?utf-8?q?Za=C5=BC") {
+		t.Errorf("Invalid data - %s", data)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layouts/base.html":  {Data: []byte(`{{define "base"}}<html>{{template "content" .}}{{template "footer"}}</html>{{end}}`)},
+		"partials/foot.html": {Data: []byte(`{{define "footer"}}<p>Bye</p>{{end}}`)},
+		"en/layouts/base.txt": {Data: []byte(`{{define "base"}}{{template "content" .}}
+--
+The app{{end}}`)},
+		"en/welcome.html": {Data: []byte(`{{define "subject"}}Welcome {{.Name}}{{end}}{{define "content"}}<p>Hi {{.Name}}</p>{{end}}{{template "base" .}}`)},
+		"en/welcome.txt":  {Data: []byte(`{{define "subject"}}Welcome {{.Name}}{{end}}{{define "content"}}Hi {{.Name}}{{end}}{{template "base" .}}`)},
+		"en/reset.html":   {Data: []byte(`{{define "subject"}}Reset & {{upper .Name}}{{end}}{{define "content"}}<a href="{{.Link}}">Reset</a>{{end}}{{template "base" .}}`)},
+		"pl/welcome.html": {Data: []byte(`{{define "subject"}}Witaj {{.Name}}{{end}}{{define "content"}}<p>Cześć {{.Name}}</p>{{end}}{{template "base" .}}`)},
+	}
+	templates, err := LoadTemplates(fsys, "en", map[string]interface{}{"upper": strings.ToUpper})
+	if err != nil {
+		t.Fatalf("LoadTemplates - %v", err)
+	}
+	data := map[string]string{"Name": "<Ann>", "Link": "https://example.com/reset?t=1"}
+
+	rendered, err := templates.Render("en-GB", "welcome", data)
+	if err != nil {
+		t.Fatalf("Render - %v", err)
+	}
+	if rendered.Subject != "Welcome <Ann>" || rendered.HTMLBody != "<html><p>Hi &lt;Ann&gt;</p><p>Bye</p></html>" || rendered.Body != "Hi <Ann>\n--\nThe app" {
+		t.Errorf("Invalid rendering - %+v", rendered)
+	}
+
+	rendered, err = templates.Render("pl-PL", "welcome", data)
+	if err != nil || rendered.Subject != "Witaj <Ann>" || rendered.Body != "" {
+		t.Errorf("Invalid locale rendering - %+v %v", rendered, err)
+	}
+	rendered, err = templates.Render("pl", "reset", data)
+	if err != nil || rendered.Subject != "Reset & <ANN>" {
+		t.Errorf("No fallback to the default locale - %+v %v", rendered, err)
+	}
+	if _, err := templates.Render("en", "missing", data); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("Missing template rendered - %v", err)
+	}
+}
+
+func TestMessageAttachments(t *testing.T) {
+	msg := testMessage()
+	msg.Cc = []string{"carol@example.org"}
+	msg.Bcc = []string{"hidden@example.org"}
+	msg.ReplyTo = "Support <support@example.com>"
+	msg.SetHeader("x-campaign", "spring")
+	msg.SetHeader("Bcc", "leak@example.org")
+	msg.Attach("invoice.pdf", []byte("%PDF-1.4"))
+	cid := msg.Embed("logo.png", []byte("PNG"))
+	msg.HTMLBody = `<img src="cid:` + cid + `">`
+
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes - %v", err)
+	}
+	if strings.Contains(string(data), "hidden@example.org") || strings.Contains(string(data), "leak@example.org") {
+		t.Errorf("Bcc in the header - %s", data)
+	}
+	parsed, _ := mail.ReadMessage(bytes.NewReader(data))
+	if parsed.Header.Get("Reply-To") != `"Support" <support@example.com>` || parsed.Header.Get("X-Campaign") != "spring" || parsed.Header.Get("Cc") != "<carol@example.org>" {
+		t.Errorf("Invalid header - %v", parsed.Header)
+	}
+	recipients, _ := msg.EnvelopeRecipients()
+	if len(recipients) != 4 || recipients[3] != "hidden@example.org" {
+		t.Errorf("Invalid recipients - %v", recipients)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if mediaType != "multipart/mixed" {
+		t.Fatalf("Invalid Content-Type - %v", mediaType)
+	}
+	r := multipart.NewReader(parsed.Body, params["boundary"])
+	parts := []*multipart.Part{}
+	contents := [][]byte{}
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := io.ReadAll(p)
+		parts = append(parts, p)
+		contents = append(contents, content)
+	}
+	if len(parts) != 2 || !strings.HasPrefix(parts[0].Header.Get("Content-Type"), "multipart/alternative") {
+		t.Fatalf("Invalid parts - %v", len(parts))
+	}
+	if parts[1].FileName() != "invoice.pdf" || parts[1].Header.Get("Content-Type") != "application/pdf" || strings.TrimSpace(string(contents[1])) != base64.StdEncoding.EncodeToString([]byte("%PDF-1.4")) {
+		t.Errorf("Invalid attachment - %v %s", parts[1].Header, contents[1])
+	}
+	if !strings.Contains(string(contents[0]), "multipart/related") || !strings.Contains(string(contents[0]), "Content-Id: <"+cid+">") {
+		t.Errorf("Inline image not related to the HTML body - %s", contents[0])
+	}
+
+	msg.Subject = "Injected\r\nBcc: someone@example.org"
+	if _, err := msg.Bytes(); err != ErrInvalidHeader {
+		t.Errorf("Header injection accepted - %v", err)
+	}
+	msg.Subject = "Invoice"
+	for _, a := range []Attachment{
+		{Name: "a.pdf\r\nBcc: someone@example.org"},
+		{Name: "a.pdf", ContentType: "application/pdf\r\nBcc: someone@example.org"},
+		{Name: "a.png", ContentID: "x\nBcc: someone@example.org"},
+	} {
+		injected := *msg
+		injected.Attachments = []Attachment{a}
+		if _, err := injected.Bytes(); err != ErrInvalidHeader {
+			t.Errorf("Header injection through an attachment accepted - %v", err)
+		}
+	}
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	msg := testMessage()
+	msg.SetHeader("X-Campaign", "Wiosenna promocja - zażółć gęślą jaźń")
+	long := strings.Repeat("<message-id@example.com> ", 6)
+	msg.SetHeader("References", strings.TrimSpace(long))
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes - %v", err)
+	}
+	header := string(data[:bytes.Index(data, []byte("\r\n\r\n"))])
+	for _, line := range strings.Split(header, "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("Header line too long - %q", line)
+		}
+		for _, ch := range line {
+			if ch > 127 {
+				t.Errorf("Non-ASCII header line - %q", line)
+				break
+			}
+		}
+	}
+	parsed, _ := mail.ReadMessage(bytes.NewReader(data))
+	campaign, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("X-Campaign"))
+	if err != nil || campaign != "Wiosenna promocja - zażółć gęślą jaźń" {
+		t.Errorf("Invalid X-Campaign - %v %v", campaign, err)
+	}
+	if parsed.Header.Get("References") != strings.TrimSpace(long) {
+		t.Errorf("Invalid References - %v", parsed.Header.Get("References"))
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	expected := []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for retries, delay := range expected {
+		if OutboxBackoff(retries) != delay {
+			t.Errorf("Invalid backoff after %v retries - %v", retries, OutboxBackoff(retries))
+		}
+	}
+	if OutboxBackoff(100) != OutboxConfig.MaxDelay {
+		t.Errorf("Backoff not capped - %v", OutboxBackoff(100))
+	}
+
+	entry := &OutboxEntry{}
+	var b bytes.Buffer
+	gob.NewEncoder(&b).Encode(testMessage())
+	entry.Data = b.Bytes()
+	msg, err := entry.Message(context.Background())
+	if err != nil || msg.Subject != testMessage().Subject || len(msg.To) != 2 {
+		t.Errorf("Invalid decoded message - %+v %v", msg, err)
+	}
+
+	now := time.Now()
+	for i := 0; i < OutboxConfig.KeptAttempts+3; i++ {
+		recordOutboxAttempt(entry, fmt.Errorf("attempt %v", i), now)
+	}
+	if len(entry.Attempts) != OutboxConfig.KeptAttempts || entry.Attempts[len(entry.Attempts)-1].Error != fmt.Sprintf("attempt %v", OutboxConfig.KeptAttempts+2) {
+		t.Errorf("Invalid attempts - %v", entry.Attempts)
+	}
+	if entry.Status != OutboxFailed || entry.Retries != OutboxConfig.KeptAttempts+3 {
+		t.Errorf("Invalid entry - %+v", entry)
+	}
+}
+
+func TestOutboxHandlersRequireCronOrAdmin(t *testing.T) {
+	w := httptest.NewRecorder()
+	OutboxWorkerHandler(w, httptest.NewRequest("GET", "/cron/outbox", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid worker status - %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	OutboxHandler(w, httptest.NewRequest("GET", "/admin/outbox", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid admin status - %v", w.Code)
+	}
+}
+
+type recordingTransport struct {
+	messages []*Message
+}
+
+func (t *recordingTransport) Send(c context.Context, msg *Message) error {
+	if msg.To[0] == "<fail@example.org>" {
+		return errors.New("rejected")
+	}
+	t.messages = append(t.messages, msg)
+	return nil
+}
+
+func TestSendBulk(t *testing.T) {
+	old := GetTransport()
+	transport := new(recordingTransport)
+	SetTransport(transport)
+	defer SetTransport(old)
+	oldList := GetSuppressionList()
+	SetSuppressionList(NewMemorySuppressionList())
+	defer SetSuppressionList(oldList)
+
+	recipients := []BulkRecipient{
+		{Address: "ann@example.org", Name: "Ann", Data: "1"},
+		{Address: "not an address"},
+		{Address: "ANN@example.org"},
+		{Address: "fail@example.org", Data: "3"},
+		{Address: "bob@example.org", Data: "2"},
+	}
+	start := time.Now()
+	report := SendBulk(context.Background(), recipients, func(r BulkRecipient) (*Message, error) {
+		return &Message{Subject: "Hi", Body: "Code " + r.Data.(string)}, nil
+	}, BulkOptions{Sender: "app@example.com", Rate: 50})
+
+	if report.Counts[BulkSent] != 2 || report.Counts[BulkInvalid] != 1 || report.Counts[BulkDuplicate] != 1 || report.Counts[BulkFailed] != 1 {
+		t.Errorf("Invalid counts - %v", report.Counts)
+	}
+	if len(transport.messages) != 2 || transport.messages[0].To[0] != `"Ann" <ann@example.org>` || transport.messages[1].Body != "Code 2" {
+		t.Errorf("Invalid messages - %v", transport.messages)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Errorf("Sending not throttled - %v", time.Since(start))
+	}
+
+	report = SendBulk(context.Background(), recipients[:1], func(r BulkRecipient) (*Message, error) {
+		return nil, nil
+	}, BulkOptions{Sender: "app@example.com"})
+	if len(report.WithStatus(BulkSkipped)) != 1 || len(transport.messages) != 2 {
+		t.Errorf("Recipient without a message not skipped - %v", report.Results)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	report = SendBulk(c, recipients[:1], nil, BulkOptions{Sender: "app@example.com"})
+	if len(report.WithStatus(BulkSkipped)) != 1 {
+		t.Errorf("Sending not stopped - %v", report.Results)
+	}
+}
+
+func TestInternationalAddresses(t *testing.T) {
+	msg := testMessage()
+	msg.To = []string{"Zoë <zoë@Bücher.de>"}
+	data, err := msg.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes - %v", err)
+	}
+	if !bytes.Contains(data, []byte("To: =?utf-8?q?Zo=C3=AB?= <zoë@xn--bcher-kva.de>\r\n")) {
+		t.Errorf("Invalid To header - %s", data)
+	}
+	if recipients, err := msg.EnvelopeRecipients(); err != nil || recipients[0] != "zoë@xn--bcher-kva.de" {
+		t.Errorf("Invalid envelope recipients - %v %v", recipients, err)
+	}
+	msg.Cc = []string{"ann@exa_mple.com"}
+	if err := msg.Validate(); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Invalid recipient accepted - %v", err)
+	}
+	if suppressionKey("Zoë <ZOË@xn--bcher-kva.de>") != suppressionKey("zoë@bücher.de") {
+		t.Errorf("Addresses not normalized - %v", suppressionKey("zoë@bücher.de"))
+	}
+	if list, err := asciiAddresses([]string{"Zoë <zoë@Bücher.de>"}); err != nil || list[0] != "=?utf-8?q?Zo=C3=AB?= <zoë@xn--bcher-kva.de>" {
+		t.Errorf("Invalid ASCII addresses - %v %v", list, err)
+	}
+	if _, err := asciiAddresses([]string{"zoe@example.org", "not an address"}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Invalid address formatted - %v", err)
+	}
+}
+
+func TestSuppression(t *testing.T) {
+	old := GetTransport()
+	catcher := NewCatcherTransport(10)
+	SetTransport(catcher)
+	defer SetTransport(old)
+	oldList := GetSuppressionList()
+	SetSuppressionList(NewMemorySuppressionList())
+	defer SetSuppressionList(oldList)
+	c := context.Background()
+
+	if err := SuppressAddress(c, "Ann <ANN@example.org>", SuppressionBounced, ""); err != nil {
+		t.Fatalf("SuppressAddress - %v", err)
+	}
+	if s, err := IsSuppressed(c, "ann@example.org"); err != nil || s == nil || s.Reason != SuppressionBounced {
+		t.Errorf("Address not suppressed - %v %v", s, err)
+	}
+	msg := testMessage()
+	msg.To = []string{"ann@example.org", "bob@example.org"}
+	msg.Bcc = []string{"Ann <Ann@example.org>"}
+	if err := Send(c, msg); err != nil {
+		t.Fatalf("Send - %v", err)
+	}
+	catcher.AssertSent(t, SentTo("bob@example.org"))
+	catcher.AssertNotSent(t, SentTo("ann@example.org"))
+	if len(msg.To) != 2 {
+		t.Errorf("Message modified - %v", msg.To)
+	}
+	if err := SendEmail(c, "Hi", []string{"ann@example.org"}, "app@example.com", "Hello"); err != ErrAllRecipientsSuppressed {
+		t.Errorf("Sent to a suppressed address - %v", err)
+	}
+
+	UnsubscribeConfig.Secret = []byte("secret")
+	UnsubscribeConfig.URL = "https://example.com/unsubscribe"
+	defer func() { UnsubscribeConfig.Secret, UnsubscribeConfig.URL = nil, "" }()
+	token, err := UnsubscribeToken("Carol <Carol@Example.org>")
+	if err != nil {
+		t.Fatalf("UnsubscribeToken - %v", err)
+	}
+	if address, err := ParseUnsubscribeToken(token); err != nil || address != "carol@example.org" {
+		t.Errorf("Invalid token address - %v %v", address, err)
+	}
+	forged, _ := UnsubscribeToken("dave@example.org")
+	forged = strings.Split(token, ".")[0] + "." + strings.Split(forged, ".")[1]
+	if _, err := ParseUnsubscribeToken(forged); err != ErrInvalidUnsubscribeToken {
+		t.Errorf("Forged token accepted - %v", err)
+	}
+
+	report := SendBulk(c, []BulkRecipient{{Address: "ann@example.org"}, {Address: "carol@example.org"}}, func(r BulkRecipient) (*Message, error) {
+		return &Message{Subject: "News", Body: "News"}, nil
+	}, BulkOptions{Sender: "app@example.com"})
+	if report.Counts[BulkSuppressed] != 1 || report.Counts[BulkSent] != 1 {
+		t.Errorf("Invalid counts - %v", report.Counts)
+	}
+	sent := catcher.Last()
+	if sent.Headers.Get("List-Unsubscribe") != "<https://example.com/unsubscribe?token="+token+">" ||
+		sent.Headers.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Errorf("Invalid unsubscribe headers - %v", sent.Headers)
+	}
+
+	w := httptest.NewRecorder()
+	UnsubscribeHandler(w, httptest.NewRequest("POST", "/unsubscribe?token="+forged, nil))
+	if w.Code != 400 || strings.Contains(w.Body.String(), ErrInvalidUnsubscribeToken.Error()) {
+		t.Errorf("Invalid response to a forged token - %v %v", w.Code, w.Body)
+	}
+}
+
+func TestAppEngineMessageHeaders(t *testing.T) {
+	headers := appEngineMessageHeaders(context.Background(), mail.Header{
+		"List-Unsubscribe":      {"<https://example.com/u>"},
+		"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+		"X-Campaign":            {"spring"},
+		"in-reply-to":           {"<1@example.com>"},
+	})
+	if len(headers) != 2 || headers["List-Unsubscribe"] == nil || headers["in-reply-to"] == nil {
+		t.Errorf("Invalid headers - %v", headers)
+	}
+}
+
+func TestCatcherTransport(t *testing.T) {
+	catcher := NewCatcherTransport(2)
+	c := context.Background()
+	for _, to := range []string{"ann@example.org", "bob@example.org", "carol@example.org"} {
+		msg := testMessage()
+		msg.To = []string{to}
+		msg.Attach("report.csv", []byte("a,b"))
+		msg.HTMLBody = `<img src="cid:` + msg.Embed("logo.png", []byte("PNG")) + `">`
+		if err := catcher.Send(c, msg); err != nil {
+			t.Fatalf("Send - %v", err)
+		}
+	}
+	catcher.AssertCount(t, 2)
+	catcher.AssertNotSent(t, SentTo("ann@example.org"))
+	catcher.AssertSent(t, SentTo("CAROL@example.org"), SentFrom("app@example.com"), SubjectContains("Za"), HasAttachment("report.csv"))
+	if catcher.Last().To[0] != "carol@example.org" {
+		t.Errorf("Invalid last message - %v", catcher.Last().To)
+	}
+
+	w := httptest.NewRecorder()
+	catcher.ServeHTTP(w, httptest.NewRequest("GET", "/inbox", nil))
+	if !strings.Contains(w.Body.String(), `<a href="?id=3">Zażółć</a>`) {
+		t.Errorf("Message not listed - %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	catcher.ServeHTTP(w, httptest.NewRequest("GET", "/inbox?id=3&html=1", nil))
+	if w.Body.String() != `<img src="?id=3&attachment=1">` {
+		t.Errorf("Inline image not served - %s", w.Body)
+	}
+	w = httptest.NewRecorder()
+	catcher.ServeHTTP(w, httptest.NewRequest("GET", "/inbox?id=3&attachment=0", nil))
+	if w.Body.String() != "a,b" || !strings.HasPrefix(w.Header().Get("Content-type"), "text/csv") {
+		t.Errorf("Attachment not served - %s %v", w.Body, w.Header())
+	}
+	for _, attachment := range []string{"0", "1"} {
+		w = httptest.NewRecorder()
+		catcher.ServeHTTP(w, httptest.NewRequest("GET", "/inbox?id=3&attachment="+attachment, nil))
+		if w.Header().Get("Content-Security-Policy") != "sandbox" || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("Attachment %v served without protection - %v", attachment, w.Header())
+		}
+	}
+	w = httptest.NewRecorder()
+	catcher.ServeHTTP(w, httptest.NewRequest("POST", "/inbox", nil))
+	catcher.AssertCount(t, 0)
+}
+
+const inboundTestMessage = "From: =?utf-8?q?Zo=C3=AB?= <zoe@example.org>\r\n" +
+	"To: support@app.appspotmail.com, \"Bob\" <bob@example.org>\r\n" +
+	"Subject: =?iso-8859-2?q?Re:_Zam=F3wienie?=\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"Message-Id: <reply1@example.org>\r\n" +
+	"In-Reply-To: <order1@app.appspotmail.com>\r\n" +
+	"Mime-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-2\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Dzi=EAkuj=EA\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+RHppxJlrdWrEmTwv\r\ncD4=\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"=?utf-8?q?faktura_=C5=BC.pdf?=\"\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQ=\r\n" +
+	"--outer--\r\n"
+
+func TestParseInboundMessage(t *testing.T) {
+	msg, err := ParseInboundMessage([]byte(inboundTestMessage))
+	if err != nil {
+		t.Fatalf("ParseInboundMessage - %v", err)
+	}
+	if msg.From.Name != "Zoë" || msg.Subject != "Re: Zamówienie" || len(msg.To) != 2 || msg.InReplyTo != "order1@app.appspotmail.com" {
+		t.Errorf("Invalid header - %+v", msg)
+	}
+	if msg.Body != "Dziękuję" || msg.HTMLBody != "<p>Dziękuję</p>" {
+		t.Errorf("Invalid bodies - %q %q", msg.Body, msg.HTMLBody)
+	}
+	if len(msg.Attachments) != 1 || msg.Attachments[0].Name != "faktura ż.pdf" || string(msg.Attachments[0].Data) != "%PDF-1.4" {
+		t.Errorf("Invalid attachments - %+v", msg.Attachments)
+	}
+
+	var received []string
+	HandleInbound("*@app.appspotmail.com", func(c context.Context, msg *InboundMessage) error {
+		received = append(received, "any "+msg.Recipient)
+		return nil
+	})
+	HandleInbound("support@app.appspotmail.com", func(c context.Context, msg *InboundMessage) error {
+		received = append(received, "support "+msg.Subject)
+		return nil
+	})
+	c := context.Background()
+	DispatchInbound(c, "Support@app.appspotmail.com", []byte(inboundTestMessage))
+	DispatchInbound(c, "sales@app.appspotmail.com", []byte(inboundTestMessage))
+	if err := DispatchInbound(c, "sales@example.org", []byte(inboundTestMessage)); !errors.Is(err, ErrNoInboundHandler) {
+		t.Errorf("Dispatched without a handler - %v", err)
+	}
+	if len(received) != 2 || received[0] != "support Re: Zamówienie" || received[1] != "any sales@app.appspotmail.com" {
+		t.Errorf("Invalid dispatch - %v", received)
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey - %v", err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edSigner, err := NewDKIMSigner("example.com", "ed", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("NewDKIMSigner - %v", err)
+	}
+	rsaSigner, err := NewDKIMSigner("example.com", "rsa", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	if err != nil {
+		t.Fatalf("NewDKIMSigner - %v", err)
+	}
+	records := map[string]string{}
+	records["ed"], _ = edSigner.DNSRecord()
+	records["rsa"], _ = rsaSigner.DNSRecord()
+	lookup := func(domain, selector string) (string, error) {
+		return records[selector], nil
+	}
+
+	data, _ := testMessage().Bytes()
+	for _, signer := range []*DKIMSigner{edSigner, rsaSigner} {
+		signed, err := signer.Sign(data)
+		if err != nil {
+			t.Fatalf("Sign - %v", err)
+		}
+		if domain, err := VerifyDKIMWithLookup(signed, lookup); err != nil || domain != "example.com" {
+			t.Errorf("%v signature not verified - %v", signer.Selector, err)
+		}
+		//Relaxed canonicalization ignores changes in whitespace
+		reformatted := bytes.Replace(signed, []byte("\r\nSubject: "), []byte("\r\nsubject:   "), 1)
+		reformatted = append(reformatted, "\r\n\r\n"...)
+		if _, err := VerifyDKIMWithLookup(reformatted, lookup); err != nil {
+			t.Errorf("%v signature broken by whitespace - %v", signer.Selector, err)
+		}
+		tampered := bytes.Replace(signed, []byte("Hello"), []byte("Hallo"), 1)
+		if _, err := VerifyDKIMWithLookup(tampered, lookup); !errors.Is(err, ErrDKIMInvalidSignature) {
+			t.Errorf("%v tampered body verified - %v", signer.Selector, err)
+		}
+		tampered = bytes.Replace(signed, []byte("To: "), []byte("To: <eve@example.org>, "), 1)
+		if _, err := VerifyDKIMWithLookup(tampered, lookup); !errors.Is(err, ErrDKIMInvalidSignature) {
+			t.Errorf("%v tampered header verified - %v", signer.Selector, err)
+		}
+	}
+	if _, err := VerifyDKIMWithLookup(data, lookup); err != ErrDKIMNoSignature {
+		t.Errorf("Unsigned message verified - %v", err)
+	}
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+	//The example of RFC 6376 section 3.4.5
+	if h := relaxedHeader("A: X\r\n"); h != "a:X\r\n" {
+		t.Errorf("Invalid header - %q", h)
+	}
+	if h := relaxedHeader("B : Y\t\r\n\tZ  \r\n"); h != "b:Y Z\r\n" {
+		t.Errorf("Invalid folded header - %q", h)
+	}
+	if body := relaxedBody([]byte(" C \r\nD \t E\r\n\r\n\r\n")); string(body) != " C\r\nD E\r\n" {
+		t.Errorf("Invalid body - %q", body)
+	}
+	if body := relaxedBody([]byte("  <p>Hello</p>  ")); string(body) != " <p>Hello</p>\r\n" {
+		t.Errorf("Leading whitespace not kept - %q", body)
+	}
+	//Body hashes of an empty body and of the example of RFC 8463 appendix A
+	for body, expected := range map[string]string{
+		"\r\n": "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe.\r\n": "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=",
+	} {
+		hash := sha256.Sum256(relaxedBody([]byte(body)))
+		if encoded := base64.StdEncoding.EncodeToString(hash[:]); encoded != expected {
+			t.Errorf("Invalid body hash of %q - %v", body, encoded)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	"golang.org/x/text/encoding/htmlindex"
+	appengine "google.golang.org/appengine/v2"
+)
+
+// Receiving mail. App Engine posts the mail sent to anything@APP_ID.appspotmail.com to
+// /_ah/mail/ADDRESS; the handlers registered for the address get it parsed:
+//
+//	Email.HandleInbound("support@app.appspotmail.com", handleSupportReply)
+//	Email.HandleInbound("*@app.appspotmail.com", handleEverythingElse)
+//	web.Mux.HandleFunc("/_ah/mail/", Email.InboundMailHandler)
+//
+// Anyone reaching the handler could make up mail, so the path must be restricted to
+// App Engine itself in app.yaml:
+//
+//	- url: /_ah/mail/.+
+//	  script: auto
+//	  login: admin
+
+// Levels of nested multiparts that are parsed
+const maxMIMEDepth = 10
+
+type InboundMessage struct {
+	//The address the mail was delivered to
+	Recipient  string
+	From       *mail.Address
+	ReplyTo    []*mail.Address
+	To         []*mail.Address
+	Cc         []*mail.Address
+	Subject    string
+	Date       time.Time
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Header     mail.Header
+	//The text and HTML bodies, converted to UTF-8
+	Body        string
+	HTMLBody    string
+	Attachments []Attachment
+	Raw         []byte
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// Converts text in the given charset to UTF-8, leaving it as it is if the charset is unknown
+func decodeCharset(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return string(data)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(decoded)
+}
+
+func decodeHeader(s string) string {
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+func parseAddressList(header mail.Header, key string) []*mail.Address {
+	if header.Get(key) == "" {
+		return nil
+	}
+	parser := mail.AddressParser{WordDecoder: headerDecoder}
+	list, err := parser.ParseList(header.Get(key))
+	if err != nil {
+		return nil
+	}
+	return list
+}
+
+func trimAngleBrackets(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "<"), ">")
+}
+
+// Parses a raw RFC 5322 message, with its MIME parts, transfer encodings and charsets
+func ParseInboundMessage(raw []byte) (*InboundMessage, error) {
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	msg := &InboundMessage{
+		Subject:   decodeHeader(parsed.Header.Get("Subject")),
+		MessageID: trimAngleBrackets(parsed.Header.Get("Message-Id")),
+		InReplyTo: trimAngleBrackets(parsed.Header.Get("In-Reply-To")),
+		Header:    parsed.Header,
+		Raw:       raw,
+		ReplyTo:   parseAddressList(parsed.Header, "Reply-To"),
+		To:        parseAddressList(parsed.Header, "To"),
+		Cc:        parseAddressList(parsed.Header, "Cc"),
+	}
+	if from := parseAddressList(parsed.Header, "From"); len(from) > 0 {
+		msg.From = from[0]
+	}
+	if date, err := parsed.Header.Date(); err == nil {
+		msg.Date = date
+	}
+	for _, ref := range strings.Fields(parsed.Header.Get("References")) {
+		msg.References = append(msg.References, trimAngleBrackets(ref))
+	}
+	err = msg.parsePart(parsed.Header.Get("Content-Type"), parsed.Header.Get("Content-Transfer-Encoding"),
+		parsed.Header.Get("Content-Disposition"), parsed.Header.Get("Content-Id"), parsed.Body, 0)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		//Line breaks are skipped by the decoder
+		return io.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(r))
+	}
+	return io.ReadAll(r)
+}
+
+func (msg *InboundMessage) parsePart(contentType, encoding, disposition, contentID string, body io.Reader, depth int) error {
+	if contentType == "" {
+		contentType = "text/plain; charset=us-ascii"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "application/octet-stream", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			return errors.New("too many nested MIME parts")
+		}
+		r := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := r.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = msg.parsePart(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"),
+				p.Header.Get("Content-Disposition"), p.Header.Get("Content-Id"), p, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := decodeTransferEncoding(encoding, body)
+	if err != nil {
+		return err
+	}
+	dispositionType, dispositionParams, _ := mime.ParseMediaType(disposition)
+	name := dispositionParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	name = decodeHeader(name)
+
+	isAttachment := dispositionType == "attachment" || name != ""
+	switch {
+	case mediaType == "text/plain" && !isAttachment && msg.Body == "":
+		msg.Body = decodeCharset(params["charset"], data)
+	case mediaType == "text/html" && !isAttachment && msg.HTMLBody == "":
+		msg.HTMLBody = decodeCharset(params["charset"], data)
+	default:
+		if name == "" {
+			name = fmt.Sprintf("part%d", len(msg.Attachments)+1)
+		}
+		msg.Attachments = append(msg.Attachments, Attachment{
+			Name:        name,
+			ContentType: mediaType,
+			Data:        data,
+			ContentID:   trimAngleBrackets(contentID),
+		})
+	}
+	return nil
+}
+
+// Handles mail received for an address
+type InboundHandler func(c context.Context, msg *InboundMessage) error
+
+var inboundHandlers struct {
+	sync.RWMutex
+	patterns map[string]InboundHandler
+}
+
+// Registers the handler for the recipients matching the pattern - an address, or an address
+// with * wildcards such as "*@app.appspotmail.com" or "reply+*@app.appspotmail.com".
+// The most specific pattern wins.
+func HandleInbound(pattern string, handler InboundHandler) {
+	inboundHandlers.Lock()
+	defer inboundHandlers.Unlock()
+	if inboundHandlers.patterns == nil {
+		inboundHandlers.patterns = map[string]InboundHandler{}
+	}
+	inboundHandlers.patterns[strings.ToLower(pattern)] = handler
+}
+
+// Returns the handler of the most specific pattern matching the recipient
+func inboundHandlerFor(recipient string) InboundHandler {
+	inboundHandlers.RLock()
+	defer inboundHandlers.RUnlock()
+	recipient = strings.ToLower(recipient)
+	if handler, ok := inboundHandlers.patterns[recipient]; ok {
+		return handler
+	}
+	var answer InboundHandler
+	best := -1
+	for pattern, handler := range inboundHandlers.patterns {
+		specificity := len(strings.ReplaceAll(pattern, "*", ""))
+		if ok, _ := path.Match(pattern, recipient); ok && specificity > best {
+			answer, best = handler, specificity
+		}
+	}
+	return answer
+}
+
+var ErrNoInboundHandler = errors.New("no handler for the recipient")
+
+// Parses the raw message and passes it to the handler registered for the recipient
+func DispatchInbound(c context.Context, recipient string, raw []byte) error {
+	msg, err := ParseInboundMessage(raw)
+	if err != nil {
+		return err
+	}
+	msg.Recipient = recipient
+	handler := inboundHandlerFor(recipient)
+	if handler == nil {
+		return fmt.Errorf("%w - %v", ErrNoInboundHandler, recipient)
+	}
+	return handler(c, msg)
+}
+
+// HTTP handler receiving mail at /_ah/mail/ADDRESS.
+// Must be mounted behind login: admin, as anyone reaching it can make up mail.
+func InboundMailHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	recipient, err := url.PathUnescape(path.Base(r.URL.Path))
+	if err != nil {
+		Log.Warningf(c, "InboundMailHandler - %v", err)
+		http.Error(w, "invalid recipient", http.StatusBadRequest)
+		return
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		Log.Errorf(c, "InboundMailHandler - %v", err)
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	err = DispatchInbound(c, recipient, raw)
+	if errors.Is(err, ErrNoInboundHandler) {
+		Log.Warningf(c, "InboundMailHandler - %v", err)
+		return
+	}
+	if err != nil {
+		Log.Errorf(c, "InboundMailHandler - %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
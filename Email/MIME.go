@@ -0,0 +1,224 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ThePiachu/Go/mymath"
+)
+
+// Building RFC 5322 messages for the transports that deliver raw mail
+
+// A part of the MIME tree, with its encoded body
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func textPart(contentType, text string) mimePart {
+	var b bytes.Buffer
+	w := quotedprintable.NewWriter(&b)
+	w.Write([]byte(text))
+	w.Close()
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return mimePart{header: header, body: b.Bytes()}
+}
+
+func multipartPart(subtype string, parts []mimePart) mimePart {
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for _, p := range parts {
+		pw, _ := w.CreatePart(p.header)
+		pw.Write(p.body)
+	}
+	w.Close()
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/"+subtype+"; boundary="+w.Boundary())
+	return mimePart{header: header, body: b.Bytes()}
+}
+
+func attachmentPart(a Attachment) mimePart {
+	var b bytes.Buffer
+	encoded := base64.StdEncoding.EncodeToString(a.Data)
+	for len(encoded) > 76 {
+		b.WriteString(encoded[:76])
+		b.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+
+	disposition := "attachment"
+	header := textproto.MIMEHeader{}
+	if a.ContentID != "" {
+		disposition = "inline"
+		header.Set("Content-Id", "<"+a.ContentID+">")
+	}
+	header.Set("Content-Type", a.contentType())
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	return mimePart{header: header, body: b.Bytes()}
+}
+
+// The text and HTML bodies as alternatives, the HTML one related to the inline images,
+// mixed with the attachments
+func (m *Message) bodyPart() mimePart {
+	parts := []mimePart{}
+	if m.Body != "" {
+		parts = append(parts, textPart("text/plain", m.Body))
+	}
+	if m.HTMLBody != "" {
+		html := []mimePart{textPart("text/html", m.HTMLBody)}
+		for _, a := range m.Attachments {
+			if a.ContentID != "" {
+				html = append(html, attachmentPart(a))
+			}
+		}
+		parts = append(parts, multipartPart("related", html))
+	}
+	mixed := []mimePart{multipartPart("alternative", parts)}
+	for _, a := range m.Attachments {
+		if a.ContentID == "" || m.HTMLBody == "" {
+			mixed = append(mixed, attachmentPart(a))
+		}
+	}
+	return multipartPart("mixed", mixed)
+}
+
+// Formats the addresses for a header, with the domains converted to ASCII
+func formatAddressList(list []string) (string, error) {
+	formatted := []string{}
+	for _, s := range list {
+		address, err := mymath.ParseEmailAddress(s)
+		if err != nil {
+			return "", err
+		}
+		formatted = append(formatted, address.String())
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+func senderDomain(sender string) string {
+	address, err := mymath.ParseEmailAddress(sender)
+	if err != nil {
+		return "localhost"
+	}
+	return address.ASCIIDomain()
+}
+
+func NewMessageID(sender string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + senderDomain(sender) + ">"
+}
+
+func canonicalHeaderKey(key string) string {
+	return textproto.CanonicalMIMEHeaderKey(key)
+}
+
+// Returns the message as RFC 5322 bytes with CRLF line endings
+func (m *Message) Bytes() ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	header := textproto.MIMEHeader{}
+	for key, values := range m.Headers {
+		key = canonicalHeaderKey(key)
+		if reservedHeaders[key] {
+			continue
+		}
+		for _, value := range values {
+			//Left as it is when it is plain ASCII
+			header[key] = append(header[key], mime.QEncoding.Encode("utf-8", value))
+		}
+	}
+	addresses := []struct {
+		key  string
+		list []string
+	}{{"From", []string{m.Sender}}, {"Reply-To", []string{m.ReplyTo}}, {"To", m.To}, {"Cc", m.Cc}}
+	for _, a := range addresses {
+		if len(a.list) == 0 || a.list[0] == "" {
+			continue
+		}
+		formatted, err := formatAddressList(a.list)
+		if err != nil {
+			return nil, err
+		}
+		header.Set(a.key, formatted)
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-Id", NewMessageID(m.Sender))
+	header.Set("Mime-Version", "1.0")
+
+	body := m.bodyPart()
+	for key, values := range body.header {
+		header[key] = values
+	}
+
+	var b bytes.Buffer
+	writeHeader(&b, header)
+	b.Write(body.body)
+	return b.Bytes(), nil
+}
+
+// Writes the header fields sorted by name, followed by the empty line ending the header
+func writeHeader(b *bytes.Buffer, header textproto.MIMEHeader) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			b.WriteString(foldHeaderLine(key + ": " + value))
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+}
+
+// Line length header fields are folded at
+const maxHeaderLineLength = 78
+
+// Breaks a header field into lines of at most maxHeaderLineLength characters, folding
+// before whitespace. Longer runs without whitespace are left on their own line.
+func foldHeaderLine(line string) string {
+	var b strings.Builder
+	//Folding is allowed anywhere after the colon
+	start := strings.Index(line, ":") + 1
+	for len(line) > maxHeaderLineLength {
+		i := strings.LastIndexAny(line[:maxHeaderLineLength+1], " \t")
+		if i < start {
+			i = strings.IndexAny(line[maxHeaderLineLength:], " \t")
+			if i < 0 {
+				break
+			}
+			i += maxHeaderLineLength
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n")
+		line = line[i:]
+		start = 1
+	}
+	b.WriteString(line)
+	return b.String()
+}
@@ -0,0 +1,172 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ThePiachu/Go/mymath"
+)
+
+// An email, sent by whichever transport is active
+type Message struct {
+	Sender  string
+	ReplyTo string
+	To      []string
+	Cc      []string
+	//Receive the mail without being listed in its header
+	Bcc     []string
+	Subject string
+	//At least one of Body and HTMLBody must be set. With both the mail is multipart/alternative.
+	Body     string
+	HTMLBody string
+	//Files attached to the mail, and images shown inline in the HTML body
+	Attachments []Attachment
+	//Extra header fields. The ones set from the fields above can't be overridden.
+	Headers mail.Header
+}
+
+type Attachment struct {
+	Name string
+	//Guessed from the name if empty
+	ContentType string
+	Data        []byte
+	//Set for inline images, referenced from the HTML body as "cid:" + ContentID
+	ContentID string
+}
+
+var ErrNoRecipients = errors.New("no recipients")
+var ErrNoBody = errors.New("no body")
+var ErrInvalidHeader = errors.New("invalid header")
+
+// Header fields built from the message itself
+var reservedHeaders = map[string]bool{
+	"From": true, "Reply-To": true, "To": true, "Cc": true, "Bcc": true, "Subject": true,
+	"Date": true, "Message-Id": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true, "Content-Disposition": true,
+}
+
+func (m *Message) Validate() error {
+	if _, err := mymath.ParseEmailAddress(m.Sender); err != nil {
+		return errors.New("invalid sender - " + err.Error())
+	}
+	if m.ReplyTo != "" {
+		if _, err := mymath.ParseEmailAddress(m.ReplyTo); err != nil {
+			return errors.New("invalid reply to - " + err.Error())
+		}
+	}
+	if len(m.Recipients()) == 0 {
+		return ErrNoRecipients
+	}
+	for _, r := range m.Recipients() {
+		if _, err := mymath.ParseEmailAddress(r); err != nil {
+			return err
+		}
+	}
+	if m.Body == "" && m.HTMLBody == "" {
+		return ErrNoBody
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return ErrInvalidHeader
+	}
+	for key, values := range m.Headers {
+		if key == "" || strings.ContainsAny(key, ": \r\n") {
+			return ErrInvalidHeader
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return ErrInvalidHeader
+			}
+		}
+	}
+	for _, a := range m.Attachments {
+		if a.Name == "" {
+			return errors.New("attachment without a name")
+		}
+		//Written to the attachment's header
+		if strings.ContainsAny(a.Name+a.ContentType+a.ContentID, "\r\n") {
+			return ErrInvalidHeader
+		}
+	}
+	return nil
+}
+
+// Returns the addresses the mail is delivered to, including Cc and Bcc
+func (m *Message) Recipients() []string {
+	answer := append([]string{}, m.To...)
+	answer = append(answer, m.Cc...)
+	return append(answer, m.Bcc...)
+}
+
+// Sets a header field, replacing its values
+func (m *Message) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = mail.Header{}
+	}
+	m.Headers[canonicalHeaderKey(key)] = []string{value}
+}
+
+// Attaches in-memory data
+func (m *Message) Attach(name string, data []byte) {
+	m.Attachments = append(m.Attachments, Attachment{Name: name, Data: data})
+}
+
+// Attaches a file, named after its base name
+func (m *Message) AttachFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	m.Attach(filepath.Base(path), data)
+	return nil
+}
+
+// Adds an inline image, returning the Content-ID to use as <img src="cid:...">
+func (m *Message) Embed(name string, data []byte) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	contentID := hex.EncodeToString(b) + "@" + senderDomain(m.Sender)
+	m.Attachments = append(m.Attachments, Attachment{Name: name, Data: data, ContentID: contentID})
+	return contentID
+}
+
+func (a Attachment) contentType() string {
+	if a.ContentType != "" {
+		return a.ContentType
+	}
+	if t := mime.TypeByExtension(filepath.Ext(a.Name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Returns the bare address part of the sender with an ASCII domain, used as the envelope sender
+func (m *Message) EnvelopeSender() (string, error) {
+	address, err := mymath.ParseEmailAddress(m.Sender)
+	if err != nil {
+		return "", err
+	}
+	return address.ASCIIAddress(), nil
+}
+
+// Returns the bare addresses of the recipients with ASCII domains, used as the envelope recipients
+func (m *Message) EnvelopeRecipients() ([]string, error) {
+	answer := []string{}
+	for _, to := range m.Recipients() {
+		address, err := mymath.ParseEmailAddress(to)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, address.ASCIIAddress())
+	}
+	return answer, nil
+}
@@ -0,0 +1,366 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ThePiachu/Go/Datastore"
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/user"
+)
+
+// Durable sending. Messages put in the outbox are stored in datastore under their
+// idempotency key, so enqueueing the same message twice sends it once, and delivered by
+// the worker handler, meant to be run from cron:
+//
+//	Email.EnqueueInOutbox(c, "invoice-"+invoiceID, msg)
+//	web.Mux.HandleFunc("/cron/outbox", Email.OutboxWorkerHandler)
+//	web.Mux.HandleFunc("/admin/outbox", Email.OutboxHandler)
+//
+// Failed deliveries are retried with exponential backoff until MaxAttempts is reached.
+// The worker's query needs a composite index on Status and NextAttempt.
+// Messages too big for the entry, usually because of their attachments, are stored
+// separately in the fake blobstore.
+
+const OutboxKind = "OutboxMessage"
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+var OutboxConfig = struct {
+	MaxAttempts int
+	//Delay after the first failed attempt, doubled after every next one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	//How long a message being delivered is hidden from other workers
+	Lease time.Duration
+	//Messages delivered by one worker run
+	BatchSize int
+	//Attempts kept in an entry's history, the older ones are forgotten
+	KeptAttempts int
+}{
+	MaxAttempts:  8,
+	BaseDelay:    time.Minute,
+	MaxDelay:     6 * time.Hour,
+	Lease:        5 * time.Minute,
+	BatchSize:    100,
+	KeptAttempts: 10,
+}
+
+// Encoded messages larger than this are kept out of the entry, which has to fit in 1MB
+const MaxInlineOutboxData = 500000
+
+type OutboxAttempt struct {
+	Time  time.Time
+	Error string
+}
+
+type OutboxEntry struct {
+	Key    string
+	Status string
+	//Attempts since the message was enqueued or resent
+	Retries     int
+	NextAttempt time.Time
+	Created     time.Time
+	Updated     time.Time
+	SentAt      time.Time
+	LastError   string `datastore:",noindex"`
+	//The latest OutboxConfig.KeptAttempts attempts
+	Attempts []OutboxAttempt `datastore:",noindex"`
+	//The gob encoded Message
+	Data []byte `datastore:",noindex" json:"-"`
+	//ID of the Message in the fake blobstore when it was too big for Data
+	BlobID string `datastore:",noindex"`
+}
+
+func (e *OutboxEntry) Message(c context.Context) (*Message, error) {
+	msg := new(Message)
+	if e.BlobID != "" {
+		if err := Datastore.GetFromFakeBlobstore(c, OutboxKind, e.BlobID, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	if err := gob.NewDecoder(bytes.NewReader(e.Data)).Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Stores the message for delivery. If a message with the same idempotency key is already
+// in the outbox it is returned instead and nothing new is sent. An empty key is replaced
+// with a random one.
+func EnqueueInOutbox(c context.Context, idempotencyKey string, msg *Message) (*OutboxEntry, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	if idempotencyKey == "" {
+		idempotencyKey = NewIdempotencyKey()
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(msg); err != nil {
+		return nil, err
+	}
+	data, blobID := b.Bytes(), ""
+	if len(data) > MaxInlineOutboxData {
+		if existing, err := GetFromOutbox(c, idempotencyKey); err == nil {
+			return existing, nil
+		}
+		//A fresh ID, so that a concurrent enqueue under the same key can't overwrite it
+		blobID = idempotencyKey + "-" + NewIdempotencyKey()
+		if err := Datastore.PutInFakeBlobstore(c, OutboxKind, blobID, msg); err != nil {
+			Log.Errorf(c, "EnqueueInOutbox - %v", err)
+			return nil, err
+		}
+		data = nil
+	}
+
+	entry := new(OutboxEntry)
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		err := Datastore.GetFromDatastoreSimple(tc, OutboxKind, idempotencyKey, entry)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, Datastore.ErrNotFound) {
+			return err
+		}
+		now := time.Now()
+		*entry = OutboxEntry{
+			Key:         idempotencyKey,
+			Status:      OutboxPending,
+			NextAttempt: now,
+			Created:     now,
+			Updated:     now,
+			Data:        data,
+			BlobID:      blobID,
+		}
+		_, err = Datastore.PutInDatastoreSimple(tc, OutboxKind, idempotencyKey, entry)
+		return err
+	}, nil)
+	if err != nil {
+		Log.Errorf(c, "EnqueueInOutbox - %v", err)
+		return nil, err
+	}
+	return entry, nil
+}
+
+func GetFromOutbox(c context.Context, idempotencyKey string) (*OutboxEntry, error) {
+	entry := new(OutboxEntry)
+	if err := Datastore.GetFromDatastoreSimple(c, OutboxKind, idempotencyKey, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Returns the most recently updated entries with the given status
+func QueryOutboxByStatus(c context.Context, status string, limit int) ([]*OutboxEntry, error) {
+	entries := []*OutboxEntry{}
+	_, err := datastore.NewQuery(OutboxKind).Filter("Status =", status).Order("-Updated").Limit(limit).GetAll(c, &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Queues a failed or sent message for delivery again
+func ResendFromOutbox(c context.Context, idempotencyKey string) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		entry := new(OutboxEntry)
+		if err := Datastore.GetFromDatastoreSimple(tc, OutboxKind, idempotencyKey, entry); err != nil {
+			return err
+		}
+		entry.Status = OutboxPending
+		entry.Retries = 0
+		entry.NextAttempt = time.Now()
+		entry.Updated = time.Now()
+		_, err := Datastore.PutInDatastoreSimple(tc, OutboxKind, idempotencyKey, entry)
+		return err
+	}, nil)
+}
+
+// Returns the delay before the next attempt after the given number of failed ones
+func OutboxBackoff(retries int) time.Duration {
+	delay := OutboxConfig.BaseDelay
+	for i := 1; i < retries && delay < OutboxConfig.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > OutboxConfig.MaxDelay {
+		delay = OutboxConfig.MaxDelay
+	}
+	return delay
+}
+
+// Takes the lease on a due message, so that concurrent workers don't send it twice.
+// Returns nil if the message isn't due anymore.
+func leaseOutboxEntry(c context.Context, idempotencyKey string) (*OutboxEntry, error) {
+	var answer *OutboxEntry
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		entry := new(OutboxEntry)
+		if err := Datastore.GetFromDatastoreSimple(tc, OutboxKind, idempotencyKey, entry); err != nil {
+			return err
+		}
+		if entry.Status != OutboxPending || entry.NextAttempt.After(time.Now()) {
+			return nil
+		}
+		entry.NextAttempt = time.Now().Add(OutboxConfig.Lease)
+		if _, err := Datastore.PutInDatastoreSimple(tc, OutboxKind, idempotencyKey, entry); err != nil {
+			return err
+		}
+		answer = entry
+		return nil
+	}, nil)
+	return answer, err
+}
+
+// Delivers a leased message and records the attempt
+func deliverOutboxEntry(c context.Context, entry *OutboxEntry) error {
+	msg, err := entry.Message(c)
+	if err == nil {
+		err = deliver(c, msg)
+	}
+	recordOutboxAttempt(entry, err, time.Now())
+	if _, putErr := Datastore.PutInDatastoreSimple(c, OutboxKind, entry.Key, entry); putErr != nil {
+		//The lease runs out and the message is sent again
+		Log.Errorf(c, "deliverOutboxEntry - %v", putErr)
+	}
+	return err
+}
+
+// Updates the entry with the outcome of a delivery attempt
+func recordOutboxAttempt(entry *OutboxEntry, err error, now time.Time) {
+	attempt := OutboxAttempt{Time: now}
+	entry.Retries++
+	entry.Updated = now
+	if err == nil {
+		entry.Status = OutboxSent
+		entry.SentAt = now
+		entry.LastError = ""
+	} else {
+		attempt.Error = err.Error()
+		entry.LastError = err.Error()
+		if entry.Retries >= OutboxConfig.MaxAttempts || errors.Is(err, ErrAllRecipientsSuppressed) {
+			entry.Status = OutboxFailed
+		} else {
+			entry.NextAttempt = now.Add(OutboxBackoff(entry.Retries))
+		}
+	}
+	entry.Attempts = append(entry.Attempts, attempt)
+	if kept := OutboxConfig.KeptAttempts; kept > 0 && len(entry.Attempts) > kept {
+		entry.Attempts = append([]OutboxAttempt{}, entry.Attempts[len(entry.Attempts)-kept:]...)
+	}
+}
+
+// Delivers up to OutboxConfig.BatchSize due messages
+func ProcessOutbox(c context.Context) (sent, failed int, err error) {
+	keys, err := datastore.NewQuery(OutboxKind).Filter("Status =", OutboxPending).Filter("NextAttempt <=", time.Now()).
+		Order("NextAttempt").Limit(OutboxConfig.BatchSize).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		entry, err := leaseOutboxEntry(c, key.StringID())
+		if err != nil {
+			Log.Errorf(c, "ProcessOutbox - %v", err)
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		if err := deliverOutboxEntry(c, entry); err != nil {
+			Log.Warningf(c, "ProcessOutbox - %v attempt %v - %v", entry.Key, entry.Retries, err)
+			failed++
+			continue
+		}
+		sent++
+	}
+	return sent, failed, nil
+}
+
+// HTTP handler for cron, delivering the due messages. Only cron and admins can run it.
+func OutboxWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" && !user.IsAdmin(c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	sent, failed, err := ProcessOutbox(c)
+	if err != nil {
+		Log.Errorf(c, "OutboxWorkerHandler - %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Sent %v, failed %v", sent, failed)
+}
+
+// Admin HTTP handler for inspecting the outbox. Requests from non-admins are refused.
+//
+//	GET ?status=failed&limit=50  - lists the entries with the status as JSON
+//	GET ?key=invoice-123         - returns one entry
+//	POST key=invoice-123         - resends the message
+func OutboxHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !user.IsAdmin(c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	key := r.FormValue("key")
+	var answer interface{}
+	var err error
+	switch {
+	case r.Method == "POST":
+		if key == "" {
+			http.Error(w, "key is required", http.StatusBadRequest)
+			return
+		}
+		if err = ResendFromOutbox(c, key); err == nil {
+			answer, err = GetFromOutbox(c, key)
+		}
+	case key != "":
+		answer, err = GetFromOutbox(c, key)
+	default:
+		status := r.FormValue("status")
+		if status == "" {
+			status = OutboxFailed
+		}
+		limit, convErr := strconv.Atoi(r.FormValue("limit"))
+		if convErr != nil || limit <= 0 {
+			limit = 100
+		}
+		answer, err = QueryOutboxByStatus(c, status, limit)
+	}
+	if errors.Is(err, Datastore.ErrNotFound) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		Log.Errorf(c, "OutboxHandler - %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(answer)
+}
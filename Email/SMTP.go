@@ -0,0 +1,171 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type StartTLSPolicy int
+
+const (
+	//Fail if the server doesn't offer STARTTLS
+	StartTLSRequired StartTLSPolicy = iota
+	//Use STARTTLS when the server offers it
+	StartTLSOpportunistic
+	//Never upgrade the connection
+	StartTLSDisabled
+)
+
+var ErrStartTLSNotSupported = errors.New("server doesn't support STARTTLS")
+
+// Sends through an SMTP server, authenticating with PLAIN when a username is set
+type SMTPTransport struct {
+	Host string
+	//587 by default, 465 with ImplicitTLS
+	Port int
+	//Connect with TLS from the start instead of upgrading with STARTTLS
+	ImplicitTLS bool
+	StartTLS    StartTLSPolicy
+	//Used for both TLS modes; the server name is set to Host if empty
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	//Name sent with EHLO, the hostname by default
+	LocalName string
+	//For connecting, 30 seconds by default
+	Timeout time.Duration
+	//Signs the messages if set
+	DKIM *DKIMSigner
+}
+
+func (t *SMTPTransport) address() string {
+	port := t.Port
+	if port == 0 {
+		port = 587
+		if t.ImplicitTLS {
+			port = 465
+		}
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+func (t *SMTPTransport) tlsConfig() *tls.Config {
+	config := &tls.Config{}
+	if t.TLSConfig != nil {
+		config = t.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = t.Host
+	}
+	return config
+}
+
+func (t *SMTPTransport) dial(c context.Context) (net.Conn, error) {
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if t.ImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: t.tlsConfig()}).DialContext(c, "tcp", t.address())
+	} else {
+		conn, err = dialer.DialContext(c, "tcp", t.address())
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn, nil
+}
+
+func (t *SMTPTransport) Send(c context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	if t.DKIM != nil {
+		if data, err = t.DKIM.Sign(data); err != nil {
+			return err
+		}
+	}
+	from, err := msg.EnvelopeSender()
+	if err != nil {
+		return err
+	}
+	to, err := msg.EnvelopeRecipients()
+	if err != nil {
+		return err
+	}
+	return t.SendRaw(c, from, to, data)
+}
+
+// Delivers an already built message to the envelope recipients
+func (t *SMTPTransport) SendRaw(c context.Context, from string, to []string, data []byte) error {
+	conn, err := t.dial(c)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	localName := t.LocalName
+	if localName == "" {
+		localName, _ = os.Hostname()
+	}
+	if localName != "" {
+		if err := client.Hello(localName); err != nil {
+			return err
+		}
+	}
+	if !t.ImplicitTLS && t.StartTLS != StartTLSDisabled {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(t.tlsConfig()); err != nil {
+				return err
+			}
+		} else if t.StartTLS == StartTLSRequired {
+			return ErrStartTLSNotSupported
+		}
+	}
+	if t.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
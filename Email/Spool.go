@@ -0,0 +1,95 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Local spools, for looking at the mail sent in development with a mail client
+
+// Writes every message as a file in a maildir's new directory
+type MaildirTransport struct {
+	Dir string
+}
+
+func NewMaildirTransport(dir string) *MaildirTransport {
+	return &MaildirTransport{Dir: dir}
+}
+
+func (t *MaildirTransport) Send(c context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%s.%s", time.Now().UnixNano(), hex.EncodeToString(b), hostname)
+
+	tmp := filepath.Join(t.Dir, "tmp", name)
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.Dir, "new", name))
+}
+
+// Appends every message to an mbox file, in the mboxrd format
+type MboxTransport struct {
+	Path string
+	lock sync.Mutex
+}
+
+func NewMboxTransport(path string) *MboxTransport {
+	return &MboxTransport{Path: path}
+}
+
+func (t *MboxTransport) Send(c context.Context, msg *Message) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := msg.EnvelopeSender()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	for _, line := range bytes.Split(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")), []byte("\n")) {
+		//">From " lines get another '>' so that they can be told apart from escaped ones
+		if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+			b.WriteByte('>')
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	f, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
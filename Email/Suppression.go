@@ -0,0 +1,259 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThePiachu/Go/Datastore"
+	"github.com/ThePiachu/Go/Log"
+	"github.com/ThePiachu/Go/mymath"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+)
+
+// Suppressed addresses - unsubscribed, bounced or complained about - don't receive mail.
+// Every send checks the recipients against the active suppression list and drops the
+// suppressed ones; a message left with no recipients fails with ErrAllRecipientsSuppressed.
+// App Engine bounce notifications can be recorded with:
+//
+//	web.Mux.HandleFunc("/_ah/bounce", Email.BounceHandler)
+//
+// The handler trusts the addresses it is given, so the path must be restricted to
+// App Engine itself in app.yaml:
+//
+//	- url: /_ah/bounce
+//	  script: auto
+//	  login: admin
+
+const SuppressionKind = "EmailSuppression"
+
+const (
+	SuppressionUnsubscribed = "unsubscribed"
+	SuppressionBounced      = "bounced"
+	SuppressionComplained   = "complained"
+	SuppressionManual       = "manual"
+)
+
+var ErrAllRecipientsSuppressed = errors.New("all recipients are suppressed")
+
+type Suppression struct {
+	//Normalized address
+	Address string
+	Reason  string
+	Created time.Time
+	Note    string `datastore:",noindex"`
+}
+
+// Stores the suppressed addresses, keyed by their normalized form
+type SuppressionList interface {
+	Suppress(c context.Context, s *Suppression) error
+	Unsuppress(c context.Context, address string) error
+	//Returns the suppressions of the addresses that have one
+	Lookup(c context.Context, addresses []string) (map[string]*Suppression, error)
+}
+
+var suppressionList struct {
+	sync.RWMutex
+	active SuppressionList
+}
+
+func init() {
+	SetSuppressionList(new(DatastoreSuppressionList))
+}
+
+func SetSuppressionList(l SuppressionList) {
+	suppressionList.Lock()
+	defer suppressionList.Unlock()
+	suppressionList.active = l
+}
+
+func GetSuppressionList() SuppressionList {
+	suppressionList.RLock()
+	defer suppressionList.RUnlock()
+	return suppressionList.active
+}
+
+// Returns the form addresses are suppressed under
+func suppressionKey(address string) string {
+	if normalized, err := mymath.NormalizeEmailAddress(address); err == nil {
+		return normalized
+	}
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func SuppressAddress(c context.Context, address, reason, note string) error {
+	err := GetSuppressionList().Suppress(c, &Suppression{
+		Address: suppressionKey(address),
+		Reason:  reason,
+		Created: time.Now(),
+		Note:    note,
+	})
+	if err != nil {
+		Log.Errorf(c, "SuppressAddress - %v", err)
+		return err
+	}
+	return nil
+}
+
+func UnsuppressAddress(c context.Context, address string) error {
+	err := GetSuppressionList().Unsuppress(c, suppressionKey(address))
+	if err != nil {
+		Log.Errorf(c, "UnsuppressAddress - %v", err)
+		return err
+	}
+	return nil
+}
+
+// Returns the suppression of the address, or nil if it isn't suppressed
+func IsSuppressed(c context.Context, address string) (*Suppression, error) {
+	key := suppressionKey(address)
+	found, err := GetSuppressionList().Lookup(c, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	return found[key], nil
+}
+
+// Returns a copy of the message without its suppressed recipients
+func withoutSuppressed(c context.Context, msg *Message) (*Message, error) {
+	keys := []string{}
+	for _, r := range msg.Recipients() {
+		keys = append(keys, suppressionKey(r))
+	}
+	found, err := GetSuppressionList().Lookup(c, keys)
+	if err != nil {
+		return nil, fmt.Errorf("checking the suppression list - %w", err)
+	}
+	if len(found) == 0 {
+		return msg, nil
+	}
+	filter := func(list []string) []string {
+		answer := []string{}
+		for _, r := range list {
+			if s := found[suppressionKey(r)]; s != nil {
+				Log.Infof(c, "Not sending to %v - %v", s.Address, s.Reason)
+				continue
+			}
+			answer = append(answer, r)
+		}
+		return answer
+	}
+	copied := *msg
+	copied.To, copied.Cc, copied.Bcc = filter(msg.To), filter(msg.Cc), filter(msg.Bcc)
+	if len(copied.Recipients()) == 0 {
+		return nil, ErrAllRecipientsSuppressed
+	}
+	return &copied, nil
+}
+
+// Sends the message through the active transport to its recipients that aren't suppressed
+func deliver(c context.Context, msg *Message) error {
+	msg, err := withoutSuppressed(c, msg)
+	if err != nil {
+		return err
+	}
+	return GetTransport().Send(c, msg)
+}
+
+// Keeps the suppressions in datastore, cached in memcache
+type DatastoreSuppressionList struct{}
+
+func suppressionMemcacheID(address string) string {
+	return SuppressionKind + "-" + address
+}
+
+func (l *DatastoreSuppressionList) Suppress(c context.Context, s *Suppression) error {
+	_, err := Datastore.PutInDatastoreSimpleAndMemcache(c, SuppressionKind, s.Address, suppressionMemcacheID(s.Address), s)
+	return err
+}
+
+func (l *DatastoreSuppressionList) Unsuppress(c context.Context, address string) error {
+	return Datastore.DeleteFromDatastoreSimpleAndMemcache(c, SuppressionKind, address, suppressionMemcacheID(address))
+}
+
+func (l *DatastoreSuppressionList) Lookup(c context.Context, addresses []string) (map[string]*Suppression, error) {
+	answer := map[string]*Suppression{}
+	memcacheIDs := []string{}
+	for _, address := range addresses {
+		memcacheIDs = append(memcacheIDs, suppressionMemcacheID(address))
+	}
+	dst := make([]Suppression, len(addresses))
+	err := Datastore.GetMultiFromDatastoreSimpleOrMemcache(c, SuppressionKind, addresses, memcacheIDs, dst)
+	multi, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+	for i := range dst {
+		if isMulti && multi[i] != nil {
+			if errors.Is(multi[i], Datastore.ErrNotFound) {
+				continue
+			}
+			return nil, multi[i]
+		}
+		answer[addresses[i]] = &dst[i]
+	}
+	return answer, nil
+}
+
+// Keeps the suppressions in memory, for tests and development
+type MemorySuppressionList struct {
+	lock         sync.RWMutex
+	suppressions map[string]*Suppression
+}
+
+func NewMemorySuppressionList() *MemorySuppressionList {
+	return &MemorySuppressionList{suppressions: map[string]*Suppression{}}
+}
+
+func (l *MemorySuppressionList) Suppress(c context.Context, s *Suppression) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.suppressions[s.Address] = s
+	return nil
+}
+
+func (l *MemorySuppressionList) Unsuppress(c context.Context, address string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.suppressions, address)
+	return nil
+}
+
+func (l *MemorySuppressionList) Lookup(c context.Context, addresses []string) (map[string]*Suppression, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	answer := map[string]*Suppression{}
+	for _, address := range addresses {
+		if s, ok := l.suppressions[address]; ok {
+			answer[address] = s
+		}
+	}
+	return answer, nil
+}
+
+// HTTP handler for App Engine bounce notifications, suppressing the bounced addresses.
+// Must be mounted behind login: admin, as anyone reaching it can suppress any address.
+func BounceHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	recipients, err := mymath.ParseEmailAddressList(r.FormValue("original-to"))
+	if err != nil {
+		Log.Warningf(c, "BounceHandler - %v", err)
+		return
+	}
+	for _, recipient := range recipients {
+		err := SuppressAddress(c, recipient.Address(), SuppressionBounced, r.FormValue("notification-subject"))
+		if err != nil {
+			//Logged by SuppressAddress
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
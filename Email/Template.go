@@ -0,0 +1,250 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+)
+
+// Templated mails. Every mail is a pair of templates, name.html and name.txt, rendered
+// from the same data into the HTML and plain text alternatives; either can be missing.
+// The subject comes from a "subject" template defined in the text or the HTML one.
+// Templates are kept per locale, with layouts and partials shared by a locale's mails:
+//
+//	layouts/base.html      shared by all the locales
+//	partials/footer.txt
+//	en/layouts/base.txt    shared by the mails of one locale
+//	en/welcome.html        {{define "subject"}}Welcome {{.Name}}{{end}}
+//	                       {{define "content"}}<p>Hi {{.Name}}</p>{{end}}{{template "base" .}}
+//	en/welcome.txt
+//	pl/welcome.html
+//
+// A locale falls back to its base language ("pt-BR" to "pt") and then the default locale.
+
+var ErrTemplateNotFound = errors.New("email template not found")
+
+type TemplateSet struct {
+	DefaultLocale string
+	locales       map[string]*localeTemplates
+}
+
+type localeTemplates struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+// The parts rendered from a template
+type RenderedEmail struct {
+	Subject  string
+	Body     string
+	HTMLBody string
+}
+
+// Loads the templates from the directories of fsys, laid out as described above.
+// funcs are made available to all the templates, next to unsubscribeURL.
+func LoadTemplates(fsys fs.FS, defaultLocale string, funcs map[string]interface{}) (*TemplateSet, error) {
+	set := &TemplateSet{DefaultLocale: defaultLocale, locales: map[string]*localeTemplates{}}
+	allFuncs := map[string]interface{}{"unsubscribeURL": UnsubscribeURL}
+	for name, f := range funcs {
+		allFuncs[name] = f
+	}
+	funcs = allFuncs
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || isSharedTemplateDir(e.Name()) {
+			continue
+		}
+		locale, err := loadLocaleTemplates(fsys, e.Name(), funcs)
+		if err != nil {
+			return nil, err
+		}
+		set.locales[e.Name()] = locale
+	}
+	if _, ok := set.locales[defaultLocale]; !ok {
+		return nil, fmt.Errorf("no templates for the default locale %v", defaultLocale)
+	}
+	return set, nil
+}
+
+func isSharedTemplateDir(name string) bool {
+	return name == "layouts" || name == "partials"
+}
+
+// Returns the files matching the patterns, in order
+func globTemplates(fsys fs.FS, patterns ...string) ([]string, error) {
+	answer := []string{}
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, matches...)
+	}
+	return answer, nil
+}
+
+func sharedTemplatePatterns(locale, ext string) []string {
+	return []string{"layouts/*" + ext, "partials/*" + ext, locale + "/layouts/*" + ext, locale + "/partials/*" + ext}
+}
+
+func loadLocaleTemplates(fsys fs.FS, locale string, funcs map[string]interface{}) (*localeTemplates, error) {
+	answer := &localeTemplates{html: map[string]*htmltemplate.Template{}, text: map[string]*texttemplate.Template{}}
+
+	shared, err := globTemplates(fsys, sharedTemplatePatterns(locale, ".html")...)
+	if err != nil {
+		return nil, err
+	}
+	htmlBase := htmltemplate.New("").Funcs(htmltemplate.FuncMap(funcs))
+	if len(shared) > 0 {
+		if htmlBase, err = htmlBase.ParseFS(fsys, shared...); err != nil {
+			return nil, err
+		}
+	}
+	mails, err := globTemplates(fsys, locale+"/*.html")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range mails {
+		t, err := htmlBase.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if t, err = t.ParseFS(fsys, file); err != nil {
+			return nil, err
+		}
+		answer.html[strings.TrimSuffix(path.Base(file), ".html")] = t.Lookup(path.Base(file))
+	}
+
+	shared, err = globTemplates(fsys, sharedTemplatePatterns(locale, ".txt")...)
+	if err != nil {
+		return nil, err
+	}
+	textBase := texttemplate.New("").Funcs(texttemplate.FuncMap(funcs))
+	if len(shared) > 0 {
+		if textBase, err = textBase.ParseFS(fsys, shared...); err != nil {
+			return nil, err
+		}
+	}
+	mails, err = globTemplates(fsys, locale+"/*.txt")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range mails {
+		t, err := textBase.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if t, err = t.ParseFS(fsys, file); err != nil {
+			return nil, err
+		}
+		answer.text[strings.TrimSuffix(path.Base(file), ".txt")] = t.Lookup(path.Base(file))
+	}
+	return answer, nil
+}
+
+// Returns the templates of the first locale in the fallback chain that has the mail
+func (s *TemplateSet) lookup(locale, name string) *localeTemplates {
+	candidates := []string{locale}
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		candidates = append(candidates, locale[:i])
+	}
+	candidates = append(candidates, s.DefaultLocale)
+	for _, candidate := range candidates {
+		t, ok := s.locales[candidate]
+		if !ok {
+			continue
+		}
+		if t.html[name] != nil || t.text[name] != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// Renders the mail in the given locale
+func (s *TemplateSet) Render(locale, name string, data interface{}) (*RenderedEmail, error) {
+	t := s.lookup(locale, name)
+	if t == nil {
+		return nil, fmt.Errorf("%w - %v", ErrTemplateNotFound, name)
+	}
+	answer := new(RenderedEmail)
+	var b bytes.Buffer
+	if h := t.html[name]; h != nil {
+		if err := h.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		answer.HTMLBody = b.String()
+	}
+	if text := t.text[name]; text != nil {
+		b.Reset()
+		if err := text.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		answer.Body = b.String()
+	}
+
+	subject, err := renderSubject(t, name, data)
+	if err != nil {
+		return nil, err
+	}
+	answer.Subject = subject
+	return answer, nil
+}
+
+func renderSubject(t *localeTemplates, name string, data interface{}) (string, error) {
+	var b bytes.Buffer
+	if text := t.text[name]; text != nil && text.Lookup("subject") != nil {
+		if err := text.ExecuteTemplate(&b, "subject", data); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(b.String()), nil
+	}
+	if h := t.html[name]; h != nil && h.Lookup("subject") != nil {
+		if err := h.ExecuteTemplate(&b, "subject", data); err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(html.UnescapeString(b.String())), nil
+	}
+	return "", fmt.Errorf("email template %v has no subject", name)
+}
+
+// Renders the mail into a message, leaving the addresses to be filled in
+func (s *TemplateSet) NewMessage(locale, name string, data interface{}) (*Message, error) {
+	rendered, err := s.Render(locale, name, data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Subject: rendered.Subject, Body: rendered.Body, HTMLBody: rendered.HTMLBody}, nil
+}
+
+func SendTemplatedEmail(c context.Context, templates *TemplateSet, locale, name string, to []string, sender string, data interface{}) error {
+	msg, err := templates.NewMessage(locale, name, data)
+	if err != nil {
+		Log.Errorf(c, "SendTemplatedEmail - %v", err)
+		return err
+	}
+	msg.Sender = sender
+	msg.To = to
+	err = deliver(c, msg)
+	if err != nil {
+		Log.Errorf(c, "SendTemplatedEmail - %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ThePiachu/Go/Log"
+	"github.com/ThePiachu/Go/mymath"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/mail"
+)
+
+// Transports deliver the messages. App Engine mail is used unless MAIL_TRANSPORT says otherwise:
+//
+//	MAIL_TRANSPORT=appengine
+//	MAIL_TRANSPORT=smtp://user@smtp.example.com:587   (STARTTLS, password in MAIL_SMTP_PASSWORD)
+//	MAIL_TRANSPORT=smtp://localhost:25?starttls=off
+//	MAIL_TRANSPORT=smtps://user@smtp.example.com:465  (implicit TLS)
+//	MAIL_TRANSPORT=maildir:/tmp/mail
+//	MAIL_TRANSPORT=mbox:/tmp/mail.mbox
+//	MAIL_TRANSPORT=memory                             (kept in memory, see MountInbox)
+
+type Transport interface {
+	Send(c context.Context, msg *Message) error
+}
+
+var transport struct {
+	sync.RWMutex
+	active Transport
+}
+
+func init() {
+	SetTransport(new(AppEngineTransport))
+	if err := ConfigureFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Email - %v\n", err)
+	}
+}
+
+func SetTransport(t Transport) {
+	transport.Lock()
+	defer transport.Unlock()
+	transport.active = t
+}
+
+func GetTransport() Transport {
+	transport.RLock()
+	defer transport.RUnlock()
+	return transport.active
+}
+
+// Sets the transport from the MAIL_TRANSPORT environment variable. Called on startup.
+func ConfigureFromEnv() error {
+	spec := os.Getenv("MAIL_TRANSPORT")
+	if spec == "" {
+		return nil
+	}
+	t, err := ParseTransport(spec)
+	if err != nil {
+		return err
+	}
+	SetTransport(t)
+	return nil
+}
+
+// Creates a transport from its MAIL_TRANSPORT description
+func ParseTransport(spec string) (Transport, error) {
+	switch {
+	case spec == "appengine":
+		return new(AppEngineTransport), nil
+	case spec == "memory":
+		return NewCatcherTransport(1000), nil
+	case strings.HasPrefix(spec, "maildir:"):
+		return NewMaildirTransport(strings.TrimPrefix(spec, "maildir:")), nil
+	case strings.HasPrefix(spec, "mbox:"):
+		return NewMboxTransport(strings.TrimPrefix(spec, "mbox:")), nil
+	case strings.HasPrefix(spec, "smtp://"), strings.HasPrefix(spec, "smtps://"):
+		return parseSMTPTransport(spec)
+	}
+	return nil, errors.New("unknown MAIL_TRANSPORT " + spec)
+}
+
+func parseSMTPTransport(spec string) (*SMTPTransport, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MAIL_TRANSPORT - %v", err)
+	}
+	t := &SMTPTransport{Host: u.Hostname(), ImplicitTLS: u.Scheme == "smtps"}
+	if port := u.Port(); port != "" {
+		if t.Port, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid MAIL_TRANSPORT port - %v", err)
+		}
+	}
+	if u.User != nil {
+		t.Username = u.User.Username()
+		t.Password, _ = u.User.Password()
+	}
+	if password := os.Getenv("MAIL_SMTP_PASSWORD"); password != "" {
+		t.Password = password
+	}
+	if t.DKIM, err = DKIMSignerFromEnv(); err != nil {
+		return nil, err
+	}
+	switch u.Query().Get("starttls") {
+	case "", "required":
+		t.StartTLS = StartTLSRequired
+	case "opportunistic":
+		t.StartTLS = StartTLSOpportunistic
+	case "off":
+		t.StartTLS = StartTLSDisabled
+	default:
+		return nil, errors.New("invalid MAIL_TRANSPORT starttls " + u.Query().Get("starttls"))
+	}
+	return t, nil
+}
+
+// Sends through the App Engine mail API
+type AppEngineTransport struct{}
+
+// Headers the App Engine mail API accepts, the others are dropped
+var appEngineHeaders = map[string]bool{
+	"Auto-Submitted":   true,
+	"In-Reply-To":      true,
+	"List-Id":          true,
+	"List-Unsubscribe": true,
+	"On-Behalf-Of":     true,
+	"References":       true,
+	"Resent-Date":      true,
+	"Resent-From":      true,
+	"Resent-To":        true,
+}
+
+// Formats the addresses with their domains converted to ASCII
+func asciiAddresses(list []string) ([]string, error) {
+	answer := []string{}
+	for _, s := range list {
+		address, err := mymath.ParseEmailAddress(s)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, address.String())
+	}
+	return answer, nil
+}
+
+// Returns the headers the mail API accepts, as it rejects messages with any other
+func appEngineMessageHeaders(c context.Context, headers map[string][]string) map[string][]string {
+	var answer map[string][]string
+	for key, values := range headers {
+		if !appEngineHeaders[canonicalHeaderKey(key)] {
+			//Set on every bulk mail next to List-Unsubscribe, so it isn't worth a warning
+			if canonicalHeaderKey(key) != "List-Unsubscribe-Post" {
+				Log.Warningf(c, "AppEngineTransport.Send - dropping the %v header, not accepted by the mail API", key)
+			}
+			continue
+		}
+		if answer == nil {
+			answer = make(map[string][]string, len(headers))
+		}
+		answer[key] = values
+	}
+	return answer
+}
+
+func (t *AppEngineTransport) Send(c context.Context, msg *Message) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	attachments := []mail.Attachment{}
+	for _, a := range msg.Attachments {
+		attachment := mail.Attachment{Name: a.Name, Data: a.Data}
+		if a.ContentID != "" {
+			attachment.ContentID = "<" + a.ContentID + ">"
+		}
+		attachments = append(attachments, attachment)
+	}
+	sender, err := asciiAddresses([]string{msg.Sender})
+	if err != nil {
+		return err
+	}
+	to, err := asciiAddresses(msg.To)
+	if err != nil {
+		return err
+	}
+	cc, err := asciiAddresses(msg.Cc)
+	if err != nil {
+		return err
+	}
+	bcc, err := asciiAddresses(msg.Bcc)
+	if err != nil {
+		return err
+	}
+	replyTo := ""
+	if msg.ReplyTo != "" {
+		formatted, err := asciiAddresses([]string{msg.ReplyTo})
+		if err != nil {
+			return err
+		}
+		replyTo = formatted[0]
+	}
+	return mail.Send(c, &mail.Message{
+		Sender:      sender[0],
+		ReplyTo:     replyTo,
+		To:          to,
+		Cc:          cc,
+		Bcc:         bcc,
+		Subject:     msg.Subject,
+		Body:        msg.Body,
+		HTMLBody:    msg.HTMLBody,
+		Attachments: attachments,
+		Headers:     appEngineMessageHeaders(c, msg.Headers),
+	})
+}
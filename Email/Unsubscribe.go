@@ -0,0 +1,154 @@
+package Email
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ThePiachu/Go/Log"
+	appengine "google.golang.org/appengine/v2"
+)
+
+// Unsubscribe links. The tokens carry the recipient's address signed with the secret, so
+// the links work without storing anything. Configured from the environment:
+//
+//	MAIL_UNSUBSCRIBE_SECRET=long-random-string
+//	MAIL_UNSUBSCRIBE_URL=https://example.com/unsubscribe
+//	web.Mux.HandleFunc("/unsubscribe", Email.UnsubscribeHandler)
+//
+// Templates get the link with {{unsubscribeURL .Email}}, and bulk mail gets the
+// List-Unsubscribe and List-Unsubscribe-Post headers for one-click unsubscribing (RFC 8058).
+
+var UnsubscribeConfig = struct {
+	//Key signing the tokens
+	Secret []byte
+	//Address of UnsubscribeHandler
+	URL string
+}{}
+
+var ErrUnsubscribeNotConfigured = errors.New("unsubscribe secret or URL not configured")
+var ErrInvalidUnsubscribeToken = errors.New("invalid unsubscribe token")
+
+func init() {
+	UnsubscribeConfig.Secret = []byte(os.Getenv("MAIL_UNSUBSCRIBE_SECRET"))
+	UnsubscribeConfig.URL = os.Getenv("MAIL_UNSUBSCRIBE_URL")
+}
+
+func unsubscribeSignature(address string) []byte {
+	h := hmac.New(sha256.New, UnsubscribeConfig.Secret)
+	h.Write([]byte("unsubscribe:" + address))
+	return h.Sum(nil)[:16]
+}
+
+// Returns the token identifying the address in unsubscribe links
+func UnsubscribeToken(address string) (string, error) {
+	if len(UnsubscribeConfig.Secret) == 0 {
+		return "", ErrUnsubscribeNotConfigured
+	}
+	address = suppressionKey(address)
+	return base64.RawURLEncoding.EncodeToString([]byte(address)) + "." +
+		base64.RawURLEncoding.EncodeToString(unsubscribeSignature(address)), nil
+}
+
+// Returns the address from a token made by UnsubscribeToken
+func ParseUnsubscribeToken(token string) (string, error) {
+	if len(UnsubscribeConfig.Secret) == 0 {
+		return "", ErrUnsubscribeNotConfigured
+	}
+	encodedAddress, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidUnsubscribeToken
+	}
+	address, err := base64.RawURLEncoding.DecodeString(encodedAddress)
+	if err != nil {
+		return "", ErrInvalidUnsubscribeToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, unsubscribeSignature(string(address))) {
+		return "", ErrInvalidUnsubscribeToken
+	}
+	return string(address), nil
+}
+
+// Returns the link unsubscribing the address
+func UnsubscribeURL(address string) (string, error) {
+	if UnsubscribeConfig.URL == "" {
+		return "", ErrUnsubscribeNotConfigured
+	}
+	token, err := UnsubscribeToken(address)
+	if err != nil {
+		return "", err
+	}
+	separator := "?"
+	if strings.Contains(UnsubscribeConfig.URL, "?") {
+		separator = "&"
+	}
+	return UnsubscribeConfig.URL + separator + "token=" + url.QueryEscape(token), nil
+}
+
+// Sets the List-Unsubscribe headers for the only recipient of the message
+func (m *Message) SetUnsubscribeHeaders() error {
+	recipients, err := m.EnvelopeRecipients()
+	if err != nil {
+		return err
+	}
+	if len(recipients) != 1 {
+		return errors.New("unsubscribe headers need a single recipient")
+	}
+	link, err := UnsubscribeURL(recipients[0])
+	if err != nil {
+		return err
+	}
+	m.SetHeader("List-Unsubscribe", "<"+link+">")
+	m.SetHeader("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	return nil
+}
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body style="font-family:sans-serif">
+{{if .Done}}<p>{{.Address}} has been unsubscribed.</p>
+{{else}}<form method="post"><p>Stop sending mail to {{.Address}}?</p>
+<input type="hidden" name="token" value="{{.Token}}"><input type="submit" value="Unsubscribe"></form>
+{{end}}</body></html>
+`))
+
+// HTTP handler for unsubscribe links. POST - the one-click request sent by mail clients
+// or the confirmation form - suppresses the address; GET only shows the form, so that
+// link scanners following it don't unsubscribe anyone.
+func UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	token := r.FormValue("token")
+	address, err := ParseUnsubscribeToken(token)
+	if err != nil {
+		Log.Warningf(c, "UnsubscribeHandler - %v", err)
+		http.Error(w, "invalid unsubscribe link", http.StatusBadRequest)
+		return
+	}
+	page := struct {
+		Address, Token string
+		Done           bool
+	}{Address: address, Token: token}
+	if r.Method == "POST" {
+		if err := SuppressAddress(c, address, SuppressionUnsubscribed, r.FormValue("List-Unsubscribe")); err != nil {
+			//Logged by SuppressAddress
+			http.Error(w, "unsubscribing failed, please try again later", http.StatusInternalServerError)
+			return
+		}
+		page.Done = true
+	}
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := unsubscribeTemplate.Execute(w, page); err != nil {
+		Log.Errorf(c, "UnsubscribeHandler - %v", err)
+	}
+}
@@ -0,0 +1,449 @@
+package ErrorDigest
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//Package for grouping the errors logged through the Log package and mailing digests of them.
+//
+//	ErrorDigest.Enable(ErrorDigest.Config{Sender: "errors@app.appspotmail.com", Recipients: []string{"dev@example.com"}})
+//	web.Mux.HandleFunc("/cron/error-digest", ErrorDigest.DigestHandler)
+//
+// Every Errorf/Criticalf (and panic caught by the web package) is fingerprinted by its calling
+// function and stack and counted, including the lines the Log package deduplicated or rate
+// limited. Counts are written to datastore as ErrorGroup entities in the background, once
+// the flush interval passed.
+// DigestHandler, meant to be run from cron, mails a digest when new groups appeared or
+// a group's rate spiked since the previous digest.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThePiachu/Go/Datastore"
+	"github.com/ThePiachu/Go/Email"
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+	"google.golang.org/appengine/v2/user"
+)
+
+const ErrorGroupKind = "ErrorGroup"
+const DigestStateKind = "ErrorDigestState"
+
+// Frames kept in a group's stack
+const maxStackDepth = 32
+
+type Config struct {
+	//Digest mail
+	Sender     string
+	Recipients []string
+	Subject    string
+
+	//Lowest level that is aggregated, LevelError by default
+	MinLevel slog.Level
+	//How often the in-memory counts are written to datastore, a minute by default
+	FlushInterval time.Duration
+	//A group spikes when its count since the last digest is at least SpikeFactor times
+	//the count in the digest before, and at least SpikeMinimum
+	SpikeFactor  float64
+	SpikeMinimum int64
+}
+
+// A group of errors sharing a fingerprint
+type ErrorGroup struct {
+	Fingerprint string
+	Level       string
+	//Function logging the error
+	Caller string
+	//File and line of the call, as of the latest occurrence
+	Location  string `datastore:",noindex"`
+	Message   string `datastore:",noindex"`
+	Stack     string `datastore:",noindex"`
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	//Occurrences since the last digest and in the digest before that
+	WindowCount         int64
+	PreviousWindowCount int64
+}
+
+type DigestState struct {
+	LastDigest time.Time
+}
+
+type pendingGroup struct {
+	group ErrorGroup
+	count int64
+}
+
+var aggregator struct {
+	sync.Mutex
+	enabled   bool
+	config    Config
+	pending   map[string]*pendingGroup
+	lastFlush time.Time
+	flushing  bool
+	//Fingerprint of the latest group seen at every call site, for the "repeated" summaries
+	byPC map[uintptr]string
+}
+
+type contextKey int
+
+// Marks the contexts used by the aggregator itself, so errors logged while storing groups
+// don't feed back into it
+const internalContextKey contextKey = 0
+
+// Starts aggregating errors by adding a sink to the Log package.
+// Call it after the sinks are configured, as Log.SetSinks removes it.
+func Enable(config Config) {
+	if config.MinLevel == 0 {
+		config.MinLevel = Log.LevelError
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Minute
+	}
+	if config.SpikeFactor <= 0 {
+		config.SpikeFactor = 3
+	}
+	if config.SpikeMinimum <= 0 {
+		config.SpikeMinimum = 10
+	}
+	if config.Subject == "" {
+		config.Subject = "Error digest"
+	}
+
+	aggregator.Lock()
+	defer aggregator.Unlock()
+	aggregator.config = config
+	aggregator.pending = map[string]*pendingGroup{}
+	aggregator.byPC = map[uintptr]string{}
+	aggregator.lastFlush = time.Now()
+	if !aggregator.enabled {
+		aggregator.enabled = true
+		Log.AddSink(new(handler))
+	}
+}
+
+// The sink receiving the log records
+type handler struct{}
+
+func (h *handler) Enabled(c context.Context, level slog.Level) bool {
+	aggregator.Lock()
+	defer aggregator.Unlock()
+	return level >= aggregator.config.MinLevel
+}
+
+func (h *handler) Handle(c context.Context, r slog.Record) error {
+	if c == nil || c.Value(internalContextKey) != nil {
+		return nil
+	}
+	//Lines the Log package held back are reported as a count on a later record
+	var repeated, suppressed int64
+	r.Attrs(func(a slog.Attr) bool {
+		switch a.Key {
+		case Log.RepeatedKey:
+			repeated = a.Value.Int64()
+		case Log.SuppressedKey:
+			suppressed = a.Value.Int64()
+		}
+		return true
+	})
+	if repeated > 0 {
+		//The summary is written from another stack, so it is counted in the group last
+		//seen at its call site
+		aggregator.Lock()
+		fingerprint, ok := aggregator.byPC[r.PC]
+		aggregator.Unlock()
+		if ok {
+			recordCount(c, ErrorGroup{Fingerprint: fingerprint}, repeated)
+			return nil
+		}
+	}
+
+	caller, location, stack := callerAndStack(r.PC)
+	group := ErrorGroup{
+		Level:    Log.LevelName(r.Level),
+		Caller:   caller,
+		Location: location,
+		Message:  r.Message,
+		Stack:    strings.Join(stack, "\n"),
+	}
+	group.Fingerprint = Fingerprint(caller, stack)
+	if r.PC != 0 {
+		aggregator.Lock()
+		aggregator.byPC[r.PC] = group.Fingerprint
+		aggregator.Unlock()
+	}
+	recordCount(c, group, 1+suppressed+repeated)
+	return nil
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// Returns the function and file:line of the call site and the functions on the stack,
+// without the frames of the runtime and the logging packages. When called while a panic
+// is being handled the stack still contains the frames that panicked.
+func callerAndStack(pc uintptr) (string, string, []string) {
+	caller, location := "???", ""
+	if pc != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+		caller = frame.Function
+		location = fmt.Sprintf("%s:%d", frame.File, frame.Line)
+	}
+
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	stack := []string{}
+	for {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame.Function) {
+			stack = append(stack, frame.Function)
+		}
+		if !more || len(stack) == maxStackDepth {
+			break
+		}
+	}
+	return caller, location, stack
+}
+
+func isInternalFrame(function string) bool {
+	for _, prefix := range []string{"runtime.", "log/slog.", "github.com/ThePiachu/Go/Log.", "github.com/ThePiachu/Go/ErrorDigest."} {
+		if strings.HasPrefix(function, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hashes the calling function and the functions on the stack. Line numbers are left out
+// so that unrelated edits don't split groups.
+func Fingerprint(caller string, stack []string) string {
+	h := sha1.New()
+	h.Write([]byte(caller))
+	for _, function := range stack {
+		h.Write([]byte("\n" + function))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Counts an occurrence of the group. Once the flush interval passed the counts are
+// written to datastore in the background, without holding up the caller.
+// Does nothing until Enable is called.
+func Record(c context.Context, group ErrorGroup) {
+	recordCount(c, group, 1)
+}
+
+func recordCount(c context.Context, group ErrorGroup, count int64) {
+	aggregator.Lock()
+	defer aggregator.Unlock()
+	if !aggregator.enabled {
+		return
+	}
+	p, ok := aggregator.pending[group.Fingerprint]
+	if !ok {
+		p = &pendingGroup{group: group}
+		p.group.FirstSeen = time.Now()
+		aggregator.pending[group.Fingerprint] = p
+	}
+	p.count += count
+	p.group.LastSeen = time.Now()
+	if group.Message != "" {
+		p.group.Message = group.Message
+		p.group.Location = group.Location
+	}
+	if !aggregator.flushing && time.Since(aggregator.lastFlush) >= aggregator.config.FlushInterval {
+		aggregator.flushing = true
+		go backgroundFlush()
+	}
+}
+
+func backgroundFlush() {
+	defer func() {
+		aggregator.Lock()
+		aggregator.flushing = false
+		aggregator.Unlock()
+	}()
+	//Not tied to a request, so it stays valid after the one that logged the error ends
+	c := internalContext(appengine.BackgroundContext())
+	if err := Flush(c); err != nil {
+		Log.Errorf(c, "ErrorDigest - %v", err)
+	}
+}
+
+func internalContext(c context.Context) context.Context {
+	return context.WithValue(c, internalContextKey, true)
+}
+
+// Writes the counts gathered by this instance to datastore
+func Flush(c context.Context) error {
+	aggregator.Lock()
+	pending := aggregator.pending
+	aggregator.pending = map[string]*pendingGroup{}
+	aggregator.lastFlush = time.Now()
+	aggregator.Unlock()
+
+	c = internalContext(c)
+	var errs []error
+	for fingerprint, p := range pending {
+		if err := flushGroup(c, fingerprint, p); err != nil {
+			errs = append(errs, err)
+			//Keep the counts for the next flush
+			aggregator.Lock()
+			if q, ok := aggregator.pending[fingerprint]; ok {
+				q.count += p.count
+			} else {
+				aggregator.pending[fingerprint] = p
+			}
+			aggregator.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Adds the pending counts of a group to the stored ones
+var flushGroup = func(c context.Context, fingerprint string, p *pendingGroup) error {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		stored := new(ErrorGroup)
+		err := Datastore.GetFromDatastoreSimple(tc, ErrorGroupKind, fingerprint, stored)
+		if err != nil && !errors.Is(err, Datastore.ErrNotFound) {
+			return err
+		}
+		if err != nil {
+			*stored = p.group
+		}
+		stored.Count += p.count
+		stored.WindowCount += p.count
+		stored.LastSeen = p.group.LastSeen
+		if p.group.Message != "" {
+			stored.Message = p.group.Message
+			stored.Location = p.group.Location
+		}
+		_, err = Datastore.PutInDatastoreSimple(tc, ErrorGroupKind, fingerprint, stored)
+		return err
+	}, nil)
+}
+
+// Returns the groups seen since the last digest that are new or spiking
+func digestGroups(config Config, groups []*ErrorGroup, since time.Time) (newGroups, spikes []*ErrorGroup) {
+	for _, g := range groups {
+		switch {
+		case g.FirstSeen.After(since):
+			newGroups = append(newGroups, g)
+		case g.WindowCount >= config.SpikeMinimum && float64(g.WindowCount) >= config.SpikeFactor*float64(g.PreviousWindowCount):
+			spikes = append(spikes, g)
+		}
+	}
+	sort.Slice(newGroups, func(i, j int) bool { return newGroups[i].WindowCount > newGroups[j].WindowCount })
+	sort.Slice(spikes, func(i, j int) bool { return spikes[i].WindowCount > spikes[j].WindowCount })
+	return newGroups, spikes
+}
+
+func formatDigest(newGroups, spikes []*ErrorGroup, since time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Errors since %v\n", since.Format(time.RFC3339))
+	write := func(title string, groups []*ErrorGroup) {
+		if len(groups) == 0 {
+			return
+		}
+		fmt.Fprintf(&b, "\n%s\n\n", title)
+		for _, g := range groups {
+			fmt.Fprintf(&b, "[%s] %s x%d (previously x%d, total %d)\n%s %s\n%s\n%s\n\n",
+				g.Level, g.Fingerprint, g.WindowCount, g.PreviousWindowCount, g.Count, g.Caller, g.Location, g.Message, g.Stack)
+		}
+	}
+	write("New errors", newGroups)
+	write("Spiking errors", spikes)
+	return b.String()
+}
+
+// Sends the digest if there is anything to report and starts a new window
+func SendDigest(c context.Context) error {
+	aggregator.Lock()
+	config := aggregator.config
+	aggregator.Unlock()
+
+	c = internalContext(c)
+	if err := Flush(c); err != nil {
+		Log.Errorf(c, "SendDigest - %v", err)
+	}
+
+	state := new(DigestState)
+	err := Datastore.GetFromDatastoreSimple(c, DigestStateKind, "state", state)
+	if err != nil && !errors.Is(err, Datastore.ErrNotFound) {
+		return err
+	}
+	now := time.Now()
+	groups := []*ErrorGroup{}
+	keys, err := datastore.NewQuery(ErrorGroupKind).Filter("LastSeen >", state.LastDigest).GetAll(c, &groups)
+	if err != nil {
+		return err
+	}
+	newGroups, spikes := digestGroups(config, groups, state.LastDigest)
+
+	if len(newGroups)+len(spikes) > 0 && len(config.Recipients) > 0 {
+		subject := fmt.Sprintf("%s - %d new, %d spiking", config.Subject, len(newGroups), len(spikes))
+		err = Email.SendEmail(c, subject, config.Recipients, config.Sender, formatDigest(newGroups, spikes, state.LastDigest))
+		if err != nil {
+			return err
+		}
+	}
+
+	//The counts reported are moved to the previous window; whatever was flushed since
+	//they were read stays in the new one
+	for i, key := range keys {
+		reported := groups[i].WindowCount
+		err := datastore.RunInTransaction(c, func(tc context.Context) error {
+			stored := new(ErrorGroup)
+			if err := datastore.Get(tc, key, stored); err != nil {
+				return err
+			}
+			stored.PreviousWindowCount = reported
+			stored.WindowCount -= reported
+			if stored.WindowCount < 0 {
+				stored.WindowCount = 0
+			}
+			_, err := datastore.Put(tc, key, stored)
+			return err
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	state.LastDigest = now
+	_, err = Datastore.PutInDatastoreSimple(c, DigestStateKind, "state", state)
+	return err
+}
+
+// HTTP handler for cron, sending the digest. Only cron and admins can run it.
+func DigestHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" && !user.IsAdmin(c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := SendDigest(c); err != nil {
+		Log.Errorf(internalContext(c), "DigestHandler - %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
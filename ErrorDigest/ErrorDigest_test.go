@@ -0,0 +1,131 @@
+package ErrorDigest
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+)
+
+func TestCallerAndStack(t *testing.T) {
+	caller, location, stack := callerAndStack(0)
+	if caller != "???" || location != "" {
+		t.Errorf("Invalid caller of an unknown pc - %v %v", caller, location)
+	}
+	if len(stack) == 0 || stack[0] != "testing.tRunner" {
+		t.Errorf("Invalid stack - %v", stack)
+	}
+	for _, function := range stack {
+		if isInternalFrame(function) {
+			t.Errorf("Internal frame on the stack - %v", function)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	stack := []string{"main.handler", "net/http.HandlerFunc.ServeHTTP"}
+	if Fingerprint("caller", stack) != Fingerprint("caller", append([]string{}, stack...)) {
+		t.Errorf("Fingerprints of the same stack differ")
+	}
+	if Fingerprint("caller", stack) == Fingerprint("other caller", stack) {
+		t.Errorf("Fingerprints of different callers match")
+	}
+	if Fingerprint("caller", stack) == Fingerprint("caller", stack[:1]) {
+		t.Errorf("Fingerprints of different stacks match")
+	}
+	if len(Fingerprint("caller", stack)) != 16 || strings.Trim(Fingerprint("caller", stack), "0123456789abcdef") != "" {
+		t.Errorf("Invalid fingerprint - %v", Fingerprint("caller", stack))
+	}
+}
+
+func TestRecordBeforeEnable(t *testing.T) {
+	Record(context.Background(), ErrorGroup{Fingerprint: "abc", Message: "failed"})
+	aggregator.Lock()
+	defer aggregator.Unlock()
+	if len(aggregator.pending) != 0 {
+		t.Errorf("Counted before Enable - %v", aggregator.pending)
+	}
+}
+
+func TestDigestHandlerRequiresCronOrAdmin(t *testing.T) {
+	w := httptest.NewRecorder()
+	DigestHandler(w, httptest.NewRequest("GET", "/cron/error-digest", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid status - %v", w.Code)
+	}
+}
+
+func TestHandlerCounts(t *testing.T) {
+	flushed := make(chan map[string]int64, 1)
+	old := flushGroup
+	defer func() { flushGroup = old }()
+	flushGroup = func(c context.Context, fingerprint string, p *pendingGroup) error {
+		flushed <- map[string]int64{fingerprint: p.count}
+		return nil
+	}
+	aggregator.Lock()
+	aggregator.enabled = true
+	defer func() {
+		aggregator.Lock()
+		aggregator.enabled = false
+		aggregator.Unlock()
+	}()
+	aggregator.config = Config{MinLevel: Log.LevelError, FlushInterval: time.Hour}
+	aggregator.pending = map[string]*pendingGroup{}
+	aggregator.byPC = map[uintptr]string{}
+	aggregator.lastFlush = time.Now()
+	aggregator.Unlock()
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	h := new(handler)
+	c := context.Background()
+	h.Handle(c, slog.NewRecord(time.Now(), Log.LevelError, "failed", pcs[0]))
+	limited := slog.NewRecord(time.Now(), Log.LevelError, "failed", pcs[0])
+	limited.AddAttrs(slog.Int(Log.SuppressedKey, 2))
+	h.Handle(c, limited)
+	//Written from elsewhere, like Log.FlushRepeated does
+	func() {
+		summary := slog.NewRecord(time.Now(), Log.LevelError, "failed - repeated 4 times", pcs[0])
+		summary.AddAttrs(slog.Int(Log.RepeatedKey, 4))
+		h.Handle(c, summary)
+	}()
+
+	aggregator.Lock()
+	if len(aggregator.pending) != 1 {
+		t.Errorf("Invalid groups - %v", aggregator.pending)
+	}
+	for _, p := range aggregator.pending {
+		if p.count != 8 {
+			t.Errorf("Invalid count - %v", p.count)
+		}
+		if p.group.Message != "failed" || !strings.Contains(p.group.Location, "ErrorDigest_test.go:") {
+			t.Errorf("Invalid group - %+v", p.group)
+		}
+	}
+	//Makes the next record start a flush
+	aggregator.lastFlush = time.Time{}
+	aggregator.Unlock()
+
+	h.Handle(c, slog.NewRecord(time.Now(), Log.LevelError, "failed", pcs[0]))
+	select {
+	case counts := <-flushed:
+		for _, count := range counts {
+			if count != 9 {
+				t.Errorf("Invalid flushed count - %v", count)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Counts not flushed")
+	}
+}
@@ -0,0 +1,114 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// How the call site is printed in front of every line. By default it is the full
+// path of the file and the line. Set on startup from the environment:
+//
+//	LOG_CALLER=short            ("mymath/RippleAddress.go:165")
+//	LOG_CALLER=short,function   ("mymath/RippleAddress.go:165 mymath.(*RippleAddress).Sign")
+//	LOG_CALLER=full,function
+
+type CallerFormat struct {
+	//Only the directory and the name of the file instead of the full path
+	ShortPath bool
+	//Appends the name of the calling function
+	Function bool
+}
+
+var callerFormat struct {
+	sync.RWMutex
+	format CallerFormat
+}
+
+func init() {
+	if err := ConfigureCallerFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Log - %v\n", err)
+	}
+}
+
+func ConfigureCallerFromEnv() error {
+	spec := os.Getenv("LOG_CALLER")
+	if spec == "" {
+		return nil
+	}
+	format := CallerFormat{}
+	for _, option := range strings.Split(spec, ",") {
+		switch strings.ToLower(strings.TrimSpace(option)) {
+		case "short":
+			format.ShortPath = true
+		case "full":
+			format.ShortPath = false
+		case "function":
+			format.Function = true
+		default:
+			return fmt.Errorf("invalid LOG_CALLER option %q", option)
+		}
+	}
+	SetCallerFormat(format)
+	return nil
+}
+
+func SetCallerFormat(format CallerFormat) {
+	callerFormat.Lock()
+	defer callerFormat.Unlock()
+	callerFormat.format = format
+}
+
+func GetCallerFormat() CallerFormat {
+	callerFormat.RLock()
+	defer callerFormat.RUnlock()
+	return callerFormat.format
+}
+
+// Returns the call site of the pc printed according to the caller format
+func FormatCaller(pc uintptr) string {
+	if pc == 0 {
+		return "???:0"
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	return formatFrame(frame.File, frame.Line, frame.Function)
+}
+
+func formatFrame(file string, line int, function string) string {
+	if file == "" {
+		file, line = "???", 0
+	}
+	format := GetCallerFormat()
+	if format.ShortPath {
+		file = ShortPath(file)
+	}
+	answer := file + ":" + strconv.Itoa(line)
+	if format.Function && function != "" {
+		answer += " " + ShortFunctionName(function)
+	}
+	return answer
+}
+
+// "/home/user/go/src/github.com/ThePiachu/Go/mymath/RippleAddress.go" -> "mymath/RippleAddress.go"
+func ShortPath(file string) string {
+	i := strings.LastIndex(file, "/")
+	if i < 0 {
+		return file
+	}
+	if j := strings.LastIndex(file[:i], "/"); j >= 0 {
+		return file[j+1:]
+	}
+	return file
+}
+
+// "github.com/ThePiachu/Go/mymath.(*CoinAddress).GetWIF" -> "mymath.(*CoinAddress).GetWIF"
+func ShortFunctionName(function string) string {
+	return function[strings.LastIndex(function, "/")+1:]
+}
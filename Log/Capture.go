@@ -0,0 +1,228 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Capturing log lines in tests. The capture is tied to a context, so parallel tests
+// each see only the lines logged with their own context:
+//
+//	c, capture := Log.StartCapture(context.Background(), 100)
+//	DoSomething(c)
+//	capture.AssertLogged(t, Log.AtLevel(Log.LevelWarning), Log.MessageContains("retrying"))
+//
+// Lines are captured whatever the level and rate limits, and are still written to
+// the sinks those allow.
+
+const captureContextKey contextKey = 1
+
+// The subset of testing.TB used by the assertions
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+type Capture struct {
+	buffer *entryBuffer
+}
+
+// Returns a context capturing the last size lines logged with it or any context derived from it
+func StartCapture(c context.Context, size int) (context.Context, *Capture) {
+	if size <= 0 {
+		size = 1
+	}
+	capture := &Capture{buffer: &entryBuffer{entries: make([]Entry, size)}}
+	return context.WithValue(c, captureContextKey, capture), capture
+}
+
+func CaptureFromContext(c context.Context) *Capture {
+	if c == nil {
+		return nil
+	}
+	capture, _ := c.Value(captureContextKey).(*Capture)
+	return capture
+}
+
+// Returns the captured entries, oldest first
+func (cp *Capture) Entries() []Entry {
+	return cp.buffer.all()
+}
+
+func (cp *Capture) Reset() {
+	cp.buffer.reset()
+}
+
+// Selects entries
+type Matcher func(Entry) bool
+
+func AtLevel(level slog.Level) Matcher {
+	return func(e Entry) bool {
+		return e.Level == level
+	}
+}
+
+func AtLeastLevel(level slog.Level) Matcher {
+	return func(e Entry) bool {
+		return e.Level >= level
+	}
+}
+
+func MessageContains(s string) Matcher {
+	return func(e Entry) bool {
+		return strings.Contains(e.Message, s)
+	}
+}
+
+// Matches entries with the attribute set to a value printing as value
+func HasAttr(key string, value interface{}) Matcher {
+	expected := fmt.Sprint(value)
+	return func(e Entry) bool {
+		v, ok := e.Attr(key)
+		return ok && v.String() == expected
+	}
+}
+
+// Matches entries logged from a "file:line" ending with location, e.g. "Email.go:22"
+func FromCaller(location string) Matcher {
+	return func(e Entry) bool {
+		return strings.HasSuffix(e.Caller, location)
+	}
+}
+
+// Returns the captured entries matching all the matchers
+func (cp *Capture) Find(matchers ...Matcher) []Entry {
+	answer := []Entry{}
+	for _, e := range cp.Entries() {
+		if matchesAll(e, matchers) {
+			answer = append(answer, e)
+		}
+	}
+	return answer
+}
+
+func (cp *Capture) Count(matchers ...Matcher) int {
+	return len(cp.Find(matchers...))
+}
+
+func (cp *Capture) Has(matchers ...Matcher) bool {
+	return cp.Count(matchers...) > 0
+}
+
+func matchesAll(e Entry, matchers []Matcher) bool {
+	for _, m := range matchers {
+		if !m(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cp *Capture) AssertLogged(t TestingT, matchers ...Matcher) {
+	t.Helper()
+	if !cp.Has(matchers...) {
+		t.Errorf("Expected log line not found. Captured:\n%s", cp)
+	}
+}
+
+func (cp *Capture) AssertNotLogged(t TestingT, matchers ...Matcher) {
+	t.Helper()
+	if found := cp.Find(matchers...); len(found) > 0 {
+		t.Errorf("Unexpected log line - %v", found[0])
+	}
+}
+
+func (cp *Capture) AssertCount(t TestingT, count int, matchers ...Matcher) {
+	t.Helper()
+	if n := cp.Count(matchers...); n != count {
+		t.Errorf("Expected %v matching log lines, found %v. Captured:\n%s", count, n, cp)
+	}
+}
+
+func (cp *Capture) String() string {
+	var b strings.Builder
+	for _, e := range cp.Entries() {
+		b.WriteString(LevelName(e.Level))
+		b.WriteString(" ")
+		b.WriteString(e.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Sits on top of the pipeline, so that lines logged with a capturing context are captured
+// even when the level or the rate limits keep them from the sinks. The captured copy goes
+// through its own context and redaction handlers.
+type captureHandler struct {
+	next    slog.Handler
+	capture slog.Handler
+}
+
+func newCaptureHandler(next slog.Handler) *captureHandler {
+	return &captureHandler{next: next, capture: &contextHandler{next: &redactHandler{next: &captureSink{}}}}
+}
+
+func (h *captureHandler) Enabled(c context.Context, level slog.Level) bool {
+	return CaptureFromContext(c) != nil || h.next.Enabled(c, level)
+}
+
+func (h *captureHandler) Handle(c context.Context, r slog.Record) error {
+	if CaptureFromContext(c) != nil {
+		h.capture.Handle(c, r.Clone())
+	}
+	if !h.next.Enabled(c, r.Level) {
+		return nil
+	}
+	return h.next.Handle(c, r)
+}
+
+func (h *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &captureHandler{next: h.next.WithAttrs(attrs), capture: h.capture.WithAttrs(attrs)}
+}
+
+func (h *captureHandler) WithGroup(name string) slog.Handler {
+	return &captureHandler{next: h.next.WithGroup(name), capture: h.capture.WithGroup(name)}
+}
+
+// Records the lines in the capture of their context
+type captureSink struct {
+	attrs []slog.Attr
+	group string
+}
+
+func (h *captureSink) Enabled(c context.Context, level slog.Level) bool {
+	return CaptureFromContext(c) != nil
+}
+
+func (h *captureSink) Handle(c context.Context, r slog.Record) error {
+	if capture := CaptureFromContext(c); capture != nil {
+		capture.buffer.add(NewEntry(r, h.attrs, h.group))
+	}
+	return nil
+}
+
+func (h *captureSink) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.group + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *captureSink) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
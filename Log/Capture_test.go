@@ -0,0 +1,57 @@
+package Log_test
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	. "github.com/ThePiachu/Go/Log"
+)
+
+func TestCapture(t *testing.T) {
+	t.Parallel()
+	c, capture := StartCapture(context.Background(), 10)
+	other, otherCapture := StartCapture(context.Background(), 10)
+
+	Warningf(c, "retrying in %v", 5)
+	Info(WithFields(c, "user", "u1"), "done", "attempts", 2)
+	Errorf(other, "unrelated")
+
+	capture.AssertLogged(t, AtLevel(LevelWarning), MessageContains("retrying"))
+	capture.AssertLogged(t, HasAttr("user", "u1"), HasAttr("attempts", 2), FromCaller("Capture_test.go:22"))
+	capture.AssertNotLogged(t, MessageContains("unrelated"))
+	capture.AssertCount(t, 2)
+	otherCapture.AssertCount(t, 1, AtLeastLevel(LevelError))
+}
+
+func TestCaptureGroups(t *testing.T) {
+	t.Parallel()
+	c, capture := StartCapture(context.Background(), 10)
+	slog.New(Handler()).WithGroup("request").With("id", 7).InfoContext(c, "done", "status", 200)
+	capture.AssertLogged(t, HasAttr("request.id", 7), HasAttr("request.status", 200))
+}
+
+func TestCaptureParallel(t *testing.T) {
+	t.Parallel()
+	c, capture := StartCapture(context.Background(), 10)
+	Debugf(c, "only mine")
+	capture.AssertCount(t, 1)
+}
+
+func TestCaptureBypassesLevelsAndLimits(t *testing.T) {
+	defer SetLevel(GetLevel())
+	SetLevel(LevelCritical)
+	SetRateLimit(0.001, 1)
+	defer SetRateLimit(0, 0)
+
+	c, capture := StartCapture(context.Background(), 10)
+	for i := 0; i < 3; i++ {
+		Debugf(c, "below the level %v", i)
+	}
+	capture.AssertCount(t, 3, AtLevel(LevelDebug))
+}
@@ -0,0 +1,130 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+
+	"golang.org/x/net/context"
+)
+
+// Request scoped fields. Whatever is stored in the context with the functions below is
+// attached to every line logged with that context, so lines of one request can be correlated.
+
+const (
+	RequestIDKey = "request_id"
+	TraceIDKey   = "trace_id"
+)
+
+type contextKey int
+
+const fieldsContextKey contextKey = 0
+
+type contextFields struct {
+	requestID string
+	traceID   string
+	attrs     []slog.Attr
+}
+
+func fieldsFromContext(c context.Context) *contextFields {
+	if c == nil {
+		return nil
+	}
+	fields, _ := c.Value(fieldsContextKey).(*contextFields)
+	return fields
+}
+
+// Returns a copy of the fields stored in c that can be modified and stored in a new context
+func copyContextFields(c context.Context) *contextFields {
+	answer := new(contextFields)
+	if fields := fieldsFromContext(c); fields != nil {
+		*answer = *fields
+		answer.attrs = append([]slog.Attr{}, fields.attrs...)
+	}
+	return answer
+}
+
+func WithRequestID(c context.Context, requestID string) context.Context {
+	fields := copyContextFields(c)
+	fields.requestID = requestID
+	return context.WithValue(c, fieldsContextKey, fields)
+}
+
+func WithTraceID(c context.Context, traceID string) context.Context {
+	fields := copyContextFields(c)
+	fields.traceID = traceID
+	return context.WithValue(c, fieldsContextKey, fields)
+}
+
+// Adds fields, given as alternating keys and values or slog.Attr values, to the context.
+// A field replaces an earlier one with the same key.
+func WithFields(c context.Context, args ...interface{}) context.Context {
+	fields := copyContextFields(c)
+	r := slog.Record{}
+	r.Add(args...)
+	r.Attrs(func(a slog.Attr) bool {
+		for i := range fields.attrs {
+			if fields.attrs[i].Key == a.Key {
+				fields.attrs = append(fields.attrs[:i], fields.attrs[i+1:]...)
+				break
+			}
+		}
+		fields.attrs = append(fields.attrs, a)
+		return true
+	})
+	return context.WithValue(c, fieldsContextKey, fields)
+}
+
+func RequestID(c context.Context) string {
+	if fields := fieldsFromContext(c); fields != nil {
+		return fields.requestID
+	}
+	return ""
+}
+
+func TraceID(c context.Context) string {
+	if fields := fieldsFromContext(c); fields != nil {
+		return fields.traceID
+	}
+	return ""
+}
+
+// Returns the request ID, trace ID and fields stored in the context as attributes
+func ContextAttrs(c context.Context) []slog.Attr {
+	fields := fieldsFromContext(c)
+	if fields == nil {
+		return nil
+	}
+	answer := make([]slog.Attr, 0, len(fields.attrs)+2)
+	if fields.requestID != "" {
+		answer = append(answer, slog.String(RequestIDKey, fields.requestID))
+	}
+	if fields.traceID != "" {
+		answer = append(answer, slog.String(TraceIDKey, fields.traceID))
+	}
+	return append(answer, fields.attrs...)
+}
+
+// Adds the attributes stored in the context to every record
+type contextHandler struct {
+	next slog.Handler
+}
+
+func (h *contextHandler) Enabled(c context.Context, level slog.Level) bool {
+	return h.next.Enabled(c, level)
+}
+
+func (h *contextHandler) Handle(c context.Context, r slog.Record) error {
+	r.AddAttrs(ContextAttrs(c)...)
+	return h.next.Handle(c, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,274 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Deduplication and rate limiting, both disabled by default.
+//
+// With a dedup window set, a message repeated from the same call site within the window is
+// logged once. There is no timer: the "repeated N times" line is written with the first
+// occurrence after the window, or by FlushRepeated, e.g. at the end of a request.
+// Messages are compared after formatting, so lines whose arguments change
+// ("Trying %v - %v") are never collapsed; use a rate limit for those.
+// With a rate limit set, every call site gets a token bucket and lines over the limit are
+// dropped; the next line that gets through carries the number of dropped ones.
+// Critical lines are never rate limited. Set on startup from the environment:
+//
+//	LOG_DEDUP_WINDOW=30s
+//	LOG_RATE_LIMIT=5   (lines per second per call site)
+//	LOG_RATE_BURST=20
+
+const (
+	RepeatedKey   = "repeated"
+	SuppressedKey = "suppressed"
+)
+
+// Call sites tracked before idle ones start being forgotten
+const maxTrackedCallSites = 10000
+
+type rateLimit struct {
+	rate  float64
+	burst int
+}
+
+var limits struct {
+	sync.Mutex
+	window    time.Duration
+	rate      rateLimit
+	perSite   map[string]rateLimit
+	repeats   map[repeatKey]*repeatState
+	buckets   map[uintptr]*tokenBucket
+	lastSweep time.Time
+}
+
+type repeatKey struct {
+	pc    uintptr
+	level slog.Level
+	msg   string
+}
+
+type repeatState struct {
+	first time.Time
+	count int
+}
+
+type tokenBucket struct {
+	limit      rateLimit
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+func init() {
+	limits.perSite = map[string]rateLimit{}
+	limits.repeats = map[repeatKey]*repeatState{}
+	limits.buckets = map[uintptr]*tokenBucket{}
+	if err := ConfigureLimitsFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Log - %v\n", err)
+	}
+}
+
+func ConfigureLimitsFromEnv() error {
+	if s := os.Getenv("LOG_DEDUP_WINDOW"); s != "" {
+		window, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_DEDUP_WINDOW - %v", err)
+		}
+		SetDedupWindow(window)
+	}
+	if s := os.Getenv("LOG_RATE_LIMIT"); s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid LOG_RATE_LIMIT - %v", err)
+		}
+		burst, err := envInt("LOG_RATE_BURST", int(rate)+1)
+		if err != nil {
+			return err
+		}
+		SetRateLimit(rate, burst)
+	}
+	return nil
+}
+
+// Identical formatted lines from one call site within the window are collapsed. 0 disables it.
+func SetDedupWindow(window time.Duration) {
+	limits.Lock()
+	defer limits.Unlock()
+	limits.window = window
+	limits.repeats = map[repeatKey]*repeatState{}
+}
+
+// Limits every call site to rate lines per second with bursts of up to burst lines.
+// A rate of 0 disables it.
+func SetRateLimit(rate float64, burst int) {
+	limits.Lock()
+	defer limits.Unlock()
+	limits.rate = rateLimit{rate: rate, burst: burst}
+	limits.buckets = map[uintptr]*tokenBucket{}
+}
+
+// Sets a limit for call sites whose "file:line" ends with location,
+// for example "mymath/RippleAddress.go:165". Overrides SetRateLimit.
+func SetCallSiteRateLimit(location string, rate float64, burst int) {
+	limits.Lock()
+	defer limits.Unlock()
+	limits.perSite[location] = rateLimit{rate: rate, burst: burst}
+	limits.buckets = map[uintptr]*tokenBucket{}
+}
+
+func ClearCallSiteRateLimit(location string) {
+	limits.Lock()
+	defer limits.Unlock()
+	delete(limits.perSite, location)
+	limits.buckets = map[uintptr]*tokenBucket{}
+}
+
+// Must be called with limits locked
+func rateLimitFor(r slog.Record) rateLimit {
+	if len(limits.perSite) > 0 {
+		location := CallerLocation(r)
+		for site, limit := range limits.perSite {
+			if strings.HasSuffix(location, site) {
+				return limit
+			}
+		}
+	}
+	return limits.rate
+}
+
+// Decides whether the record should be written. Returns the summary of earlier repeats
+// that has to be written before it, if any.
+func checkLimits(r slog.Record) (allow bool, summary *slog.Record, suppressed int) {
+	limits.Lock()
+	defer limits.Unlock()
+
+	now := time.Now()
+	sweepLimits(now)
+
+	if limits.window > 0 {
+		key := repeatKey{pc: r.PC, level: r.Level, msg: r.Message}
+		state, ok := limits.repeats[key]
+		if ok && now.Sub(state.first) < limits.window {
+			state.count++
+			return false, nil, 0
+		}
+		if ok && state.count > 0 {
+			summary = repeatSummary(r, state.count)
+		}
+		limits.repeats[key] = &repeatState{first: now}
+	}
+
+	if r.Level >= LevelCritical {
+		return true, summary, 0
+	}
+	limit := rateLimitFor(r)
+	if limit.rate <= 0 {
+		return true, summary, 0
+	}
+	bucket, ok := limits.buckets[r.PC]
+	if !ok || bucket.limit != limit {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.burst), last: now}
+		limits.buckets[r.PC] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * limit.rate
+	if bucket.tokens > float64(limit.burst) {
+		bucket.tokens = float64(limit.burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		bucket.suppressed++
+		return false, summary, 0
+	}
+	bucket.tokens--
+	suppressed, bucket.suppressed = bucket.suppressed, 0
+	return true, summary, suppressed
+}
+
+func repeatSummary(r slog.Record, count int) *slog.Record {
+	summary := slog.NewRecord(time.Now(), r.Level, r.Message+" - repeated "+strconv.Itoa(count)+" times", r.PC)
+	summary.AddAttrs(slog.Int(RepeatedKey, count))
+	return &summary
+}
+
+// Forgets call sites that haven't been seen for a while. Must be called with limits locked.
+func sweepLimits(now time.Time) {
+	if len(limits.repeats)+len(limits.buckets) < maxTrackedCallSites || now.Sub(limits.lastSweep) < time.Second {
+		return
+	}
+	limits.lastSweep = now
+	for key, state := range limits.repeats {
+		if now.Sub(state.first) >= limits.window && state.count == 0 {
+			delete(limits.repeats, key)
+		}
+	}
+	if len(limits.buckets) >= maxTrackedCallSites {
+		limits.buckets = map[uintptr]*tokenBucket{}
+	}
+}
+
+// Writes the "repeated N times" lines for every message still inside its window
+func FlushRepeated(c context.Context) {
+	limits.Lock()
+	summaries := []*slog.Record{}
+	for key, state := range limits.repeats {
+		if state.count > 0 {
+			r := slog.NewRecord(time.Now(), key.level, key.msg, key.pc)
+			summaries = append(summaries, repeatSummary(r, state.count))
+		}
+		delete(limits.repeats, key)
+	}
+	limits.Unlock()
+
+	sinks.RLock()
+	h := sinks.afterLimits
+	sinks.RUnlock()
+	for _, r := range summaries {
+		h.Handle(c, *r)
+	}
+}
+
+// Applies deduplication and rate limits to the records
+type limitHandler struct {
+	next slog.Handler
+}
+
+func (h *limitHandler) Enabled(c context.Context, level slog.Level) bool {
+	return h.next.Enabled(c, level)
+}
+
+func (h *limitHandler) Handle(c context.Context, r slog.Record) error {
+	allow, summary, suppressed := checkLimits(r)
+	if summary != nil {
+		if err := h.next.Handle(c, *summary); err != nil {
+			return err
+		}
+	}
+	if !allow {
+		return nil
+	}
+	if suppressed > 0 {
+		r.AddAttrs(slog.Int(SuppressedKey, suppressed))
+	}
+	return h.next.Handle(c, r)
+}
+
+func (h *limitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &limitHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *limitHandler) WithGroup(name string) slog.Handler {
+	return &limitHandler{next: h.next.WithGroup(name)}
+}
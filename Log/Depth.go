@@ -0,0 +1,95 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Logging from helpers. A function wrapping the Log functions reports its own location
+// as the caller; logging through WithDepth skips that many more frames instead:
+//
+//	func logFailure(c context.Context, err error) {
+//		Log.WithDepth(1).Errorf(c, "Request failed - %v", err)
+//	}
+
+// Logs with the caller looked up depth frames further up the stack
+type Logger struct {
+	depth int
+}
+
+// Returns a Logger skipping depth frames above the function calling it.
+// WithDepth(0) behaves like the package functions.
+func WithDepth(depth int) Logger {
+	if depth < 0 {
+		depth = 0
+	}
+	return Logger{depth: depth}
+}
+
+// Returns a Logger skipping depth more frames than l
+func (l Logger) WithDepth(depth int) Logger {
+	return WithDepth(l.depth + depth)
+}
+
+func (l Logger) Debugf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelDebug, l.depth+1, formatArgs(format, args))
+}
+
+func (l Logger) Infof(c context.Context, format string, args ...interface{}) {
+	output(c, LevelInfo, l.depth+1, formatArgs(format, args))
+}
+
+func (l Logger) Warningf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelWarning, l.depth+1, formatArgs(format, args))
+}
+
+func (l Logger) Errorf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelError, l.depth+1, formatArgs(format, args))
+}
+
+func (l Logger) Criticalf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelCritical, l.depth+1, formatArgs(format, args))
+}
+
+func (l Logger) JDebugf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelDebug, l.depth+1, formatJSON(format, args))
+}
+
+func (l Logger) JInfof(c context.Context, format string, args ...interface{}) {
+	output(c, LevelInfo, l.depth+1, formatJSON(format, args))
+}
+
+func (l Logger) JWarningf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelWarning, l.depth+1, formatJSON(format, args))
+}
+
+func (l Logger) JErrorf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelError, l.depth+1, formatJSON(format, args))
+}
+
+func (l Logger) JCriticalf(c context.Context, format string, args ...interface{}) {
+	output(c, LevelCritical, l.depth+1, formatJSON(format, args))
+}
+
+func (l Logger) Debug(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelDebug, l.depth+1, msg, args...)
+}
+
+func (l Logger) Info(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelInfo, l.depth+1, msg, args...)
+}
+
+func (l Logger) Warning(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelWarning, l.depth+1, msg, args...)
+}
+
+func (l Logger) Error(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelError, l.depth+1, msg, args...)
+}
+
+func (l Logger) Critical(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelCritical, l.depth+1, msg, args...)
+}
@@ -0,0 +1,163 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/log"
+)
+
+// Levels used by the package. Critical sits above slog's own levels.
+const (
+	LevelDebug    = slog.LevelDebug
+	LevelInfo     = slog.LevelInfo
+	LevelWarning  = slog.LevelWarn
+	LevelError    = slog.LevelError
+	LevelCritical = slog.Level(12)
+)
+
+func LevelName(level slog.Level) string {
+	switch {
+	case level >= LevelCritical:
+		return "CRITICAL"
+	case level >= LevelError:
+		return "ERROR"
+	case level >= LevelWarning:
+		return "WARNING"
+	case level >= LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// Returns the "file:line" of the record's caller with the full path, or "???:0" if unknown.
+// Used for matching call sites regardless of the caller format.
+func CallerLocation(r slog.Record) string {
+	file, line := "???", 0
+	if r.PC != 0 {
+		frames := runtime.CallersFrames([]uintptr{r.PC})
+		frame, _ := frames.Next()
+		if frame.File != "" {
+			file, line = frame.File, frame.Line
+		}
+	}
+	return file + ":" + strconv.Itoa(line)
+}
+
+// Formats the record the way the package always has - "file:line - message",
+// followed by the record's attributes as key=value pairs. The call site is printed
+// according to the caller format.
+func FormatRecord(r slog.Record, attrs []slog.Attr, group string) string {
+	var b strings.Builder
+	b.WriteString(FormatCaller(r.PC))
+	b.WriteString(" - ")
+	b.WriteString(r.Message)
+	for _, a := range attrs {
+		appendAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&b, group, a)
+		return true
+	})
+	return b.String()
+}
+
+func appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	b.WriteString(" ")
+	b.WriteString(prefix)
+	b.WriteString(a.Key)
+	b.WriteString("=")
+	s := a.Value.String()
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		s = strconv.Quote(s)
+	}
+	b.WriteString(s)
+}
+
+// A slog.Handler writing through the App Engine log API
+type AppEngineHandler struct {
+	attrs []slog.Attr
+	group string
+}
+
+func NewAppEngineHandler() *AppEngineHandler {
+	return new(AppEngineHandler)
+}
+
+func (h *AppEngineHandler) Enabled(c context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *AppEngineHandler) Handle(c context.Context, r slog.Record) error {
+	msg := FormatRecord(r, h.attrs, h.group)
+	switch {
+	case r.Level >= LevelCritical:
+		log.Criticalf(c, "%s", msg)
+	case r.Level >= LevelError:
+		log.Errorf(c, "%s", msg)
+	case r.Level >= LevelWarning:
+		log.Warningf(c, "%s", msg)
+	case r.Level >= LevelInfo:
+		log.Infof(c, "%s", msg)
+	default:
+		log.Debugf(c, "%s", msg)
+	}
+	return nil
+}
+
+func (h *AppEngineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	h2.attrs = append(h2.attrs, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + a.Key
+		}
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+func (h *AppEngineHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// Emits a log record. skip is the number of stack frames above output to skip when
+// looking for the caller, so a public function calling output directly passes 1.
+func output(c context.Context, level slog.Level, skip int, msg string, args ...interface{}) {
+	var pcs [1]uintptr
+	runtime.Callers(skip+2, pcs[:])
+	r := slog.NewRecord(time.Now(), level, msg, pcs[0])
+	r.Add(args...)
+	if err := Handler().Handle(c, r); err != nil {
+		fmt.Fprintf(os.Stderr, "Log - %v\n", err)
+	}
+}
@@ -0,0 +1,271 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/user"
+)
+
+// Minimum levels. Lines below the global level are dropped, unless the package they are
+// logged from has its own level. Packages are matched by import path, by their last path
+// elements ("mymath" matches "github.com/ThePiachu/Go/mymath") and include their sub-packages.
+// Set on startup from the environment:
+//
+//	LOG_LEVEL=info
+//	LOG_LEVEL_OVERRIDES=mymath=warning,github.com/ThePiachu/Go/Datastore=debug
+
+var levels struct {
+	sync.RWMutex
+	min       slog.Level
+	overrides map[string]slog.Level
+}
+
+// Caches the package of every call site seen
+var callerPackages sync.Map
+
+func init() {
+	levels.min = LevelDebug
+	levels.overrides = map[string]slog.Level{}
+	if err := ConfigureLevelsFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Log - %v\n", err)
+	}
+}
+
+func ConfigureLevelsFromEnv() error {
+	if s := os.Getenv("LOG_LEVEL"); s != "" {
+		level, err := ParseLevel(s)
+		if err != nil {
+			return err
+		}
+		SetLevel(level)
+	}
+	overrides := os.Getenv("LOG_LEVEL_OVERRIDES")
+	if overrides == "" {
+		return nil
+	}
+	for _, override := range strings.Split(overrides, ",") {
+		parts := strings.SplitN(strings.TrimSpace(override), "=", 2)
+		if len(parts) != 2 {
+			return errors.New("invalid LOG_LEVEL_OVERRIDES entry " + override)
+		}
+		level, err := ParseLevel(parts[1])
+		if err != nil {
+			return err
+		}
+		SetPackageLevel(parts[0], level)
+	}
+	return nil
+}
+
+// Parses the level names used by the package ("debug", "info", "warning", "error", "critical")
+// as well as slog's names such as "WARN" or "INFO+2"
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warning", "warn":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	case "critical":
+		return LevelCritical, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return level, nil
+}
+
+func SetLevel(level slog.Level) {
+	levels.Lock()
+	defer levels.Unlock()
+	levels.min = level
+}
+
+func GetLevel() slog.Level {
+	levels.RLock()
+	defer levels.RUnlock()
+	return levels.min
+}
+
+func SetPackageLevel(pkg string, level slog.Level) {
+	levels.Lock()
+	defer levels.Unlock()
+	levels.overrides[pkg] = level
+}
+
+func ClearPackageLevel(pkg string) {
+	levels.Lock()
+	defer levels.Unlock()
+	delete(levels.overrides, pkg)
+}
+
+func PackageLevels() map[string]slog.Level {
+	levels.RLock()
+	defer levels.RUnlock()
+	answer := make(map[string]slog.Level, len(levels.overrides))
+	for pkg, level := range levels.overrides {
+		answer[pkg] = level
+	}
+	return answer
+}
+
+// Returns the minimum level for the given package, using the most specific override
+func LevelForPackage(pkg string) slog.Level {
+	levels.RLock()
+	defer levels.RUnlock()
+	level, best := levels.min, -1
+	for key, l := range levels.overrides {
+		if matchesPackage(pkg, key) && len(key) > best {
+			level, best = l, len(key)
+		}
+	}
+	return level
+}
+
+func matchesPackage(pkg, key string) bool {
+	for {
+		if pkg == key || strings.HasSuffix(pkg, "/"+key) {
+			return true
+		}
+		i := strings.LastIndex(pkg, "/")
+		if i < 0 {
+			return false
+		}
+		pkg = pkg[:i]
+	}
+}
+
+// Returns the lowest level that any package logs at
+func lowestLevel() slog.Level {
+	levels.RLock()
+	defer levels.RUnlock()
+	level := levels.min
+	for _, l := range levels.overrides {
+		if l < level {
+			level = l
+		}
+	}
+	return level
+}
+
+// Returns the import path of the package the pc belongs to
+func CallerPackage(pc uintptr) string {
+	if pkg, ok := callerPackages.Load(pc); ok {
+		return pkg.(string)
+	}
+	pkg := ""
+	if f := runtime.FuncForPC(pc); f != nil {
+		pkg = packageFromFunction(f.Name())
+	}
+	callerPackages.Store(pc, pkg)
+	return pkg
+}
+
+// "github.com/ThePiachu/Go/mymath.(*CoinAddress).GetWIF" -> "github.com/ThePiachu/Go/mymath"
+func packageFromFunction(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot]
+	}
+	return name
+}
+
+// Drops records below the level of the package they were logged from
+type levelHandler struct {
+	next slog.Handler
+}
+
+func (h *levelHandler) Enabled(c context.Context, level slog.Level) bool {
+	return level >= lowestLevel() && h.next.Enabled(c, level)
+}
+
+func (h *levelHandler) Handle(c context.Context, r slog.Record) error {
+	if r.Level < LevelForPackage(CallerPackage(r.PC)) {
+		return nil
+	}
+	return h.next.Handle(c, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{next: h.next.WithGroup(name)}
+}
+
+type levelsState struct {
+	Level    string
+	Packages map[string]string
+}
+
+func currentLevelsState() levelsState {
+	state := levelsState{Level: LevelName(GetLevel()), Packages: map[string]string{}}
+	for pkg, level := range PackageLevels() {
+		state.Packages[pkg] = LevelName(level)
+	}
+	return state
+}
+
+// Admin HTTP handler for changing levels at runtime, for example
+// web.Mux.HandleFunc("/admin/log/levels", Log.LevelsHandler). Requests from users who
+// aren't App Engine admins are refused. The levels are kept in memory, so a change only
+// applies to the instance serving the request and is lost when it restarts - use
+// LOG_LEVEL and LOG_LEVEL_OVERRIDES for lasting changes.
+//
+//	GET                              - returns the levels as JSON
+//	POST level=warning               - sets the global level
+//	POST package=mymath&level=error  - sets a package level
+//	DELETE ?package=mymath           - removes a package level
+func LevelsHandler(w http.ResponseWriter, r *http.Request) {
+	if !user.IsAdmin(appengine.NewContext(r)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	pkg := r.FormValue("package")
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		level, err := ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if pkg == "" {
+			SetLevel(level)
+		} else {
+			SetPackageLevel(pkg, level)
+		}
+		Infof(r.Context(), "LevelsHandler - level of %q set to %v", pkg, LevelName(level))
+	case "DELETE":
+		if pkg == "" {
+			http.Error(w, "package is required", http.StatusBadRequest)
+			return
+		}
+		ClearPackageLevel(pkg)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(currentLevelsState())
+}
@@ -6,56 +6,32 @@ package Log
 
 import (
 	"encoding/json"
+	"fmt"
 	"golang.org/x/net/context"
-	//"google.golang.org/appengine"
-	"google.golang.org/appengine/v2/log"
-	"runtime"
-	"strconv"
 )
 
+func formatArgs(format string, args []interface{}) string {
+	return fmt.Sprintf(format, redactArgs(args)...)
+}
+
 func Debugf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Debugf(c, file+":"+strconv.Itoa(line)+" - "+format, args...)
+	output(c, LevelDebug, 1, formatArgs(format, args))
 }
 
 func Infof(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Infof(c, file+":"+strconv.Itoa(line)+" - "+format, args...)
+	output(c, LevelInfo, 1, formatArgs(format, args))
 }
 
 func Warningf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Warningf(c, file+":"+strconv.Itoa(line)+" - "+format, args...)
+	output(c, LevelWarning, 1, formatArgs(format, args))
 }
 
 func Errorf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Errorf(c, file+":"+strconv.Itoa(line)+" - "+format, args...)
+	output(c, LevelError, 1, formatArgs(format, args))
 }
 
 func Criticalf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Criticalf(c, file+":"+strconv.Itoa(line)+" - "+format, args...)
+	output(c, LevelCritical, 1, formatArgs(format, args))
 }
 
 //JSON debugs
@@ -74,47 +50,26 @@ func encodeJSONString(data interface{}) string {
 	return string(encoded)
 }
 
+func formatJSON(format string, args []interface{}) string {
+	return fmt.Sprintf(format, argsToJSON(redactArgs(args)...)...)
+}
+
 func JDebugf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Debugf(c, file+":"+strconv.Itoa(line)+" - "+format, argsToJSON(args)...)
+	output(c, LevelDebug, 1, formatJSON(format, args))
 }
 
 func JInfof(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Infof(c, file+":"+strconv.Itoa(line)+" - "+format, argsToJSON(args)...)
+	output(c, LevelInfo, 1, formatJSON(format, args))
 }
 
 func JWarningf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Warningf(c, file+":"+strconv.Itoa(line)+" - "+format, argsToJSON(args)...)
+	output(c, LevelWarning, 1, formatJSON(format, args))
 }
 
 func JErrorf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Errorf(c, file+":"+strconv.Itoa(line)+" - "+format, argsToJSON(args)...)
+	output(c, LevelError, 1, formatJSON(format, args))
 }
 
 func JCriticalf(c context.Context, format string, args ...interface{}) {
-	_, file, line, ok := runtime.Caller(1)
-	if !ok {
-		file = "???"
-		line = 0
-	}
-	log.Criticalf(c, file+":"+strconv.Itoa(line)+" - "+format, argsToJSON(args)...)
+	output(c, LevelCritical, 1, formatJSON(format, args))
 }
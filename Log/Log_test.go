@@ -0,0 +1,314 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Resets the settings read from the environment, so that LOG_LEVEL and the like
+// of the machine running the tests don't change their outcome
+func TestMain(m *testing.M) {
+	SetLevel(LevelDebug)
+	for pkg := range PackageLevels() {
+		ClearPackageLevel(pkg)
+	}
+	SetDedupWindow(0)
+	SetRateLimit(0, 0)
+	SetRedaction(true)
+	SetCallerFormat(CallerFormat{})
+	os.Exit(m.Run())
+}
+
+type recordingHandler struct {
+	records []slog.Record
+}
+
+func (h *recordingHandler) Enabled(c context.Context, level slog.Level) bool { return true }
+func (h *recordingHandler) Handle(c context.Context, r slog.Record) error {
+	h.records = append(h.records, r)
+	return nil
+}
+func (h *recordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(name string) slog.Handler       { return h }
+
+func TestStructuredLogging(t *testing.T) {
+	old := Sinks()
+	rec := new(recordingHandler)
+	SetSinks(rec)
+	defer SetSinks(old...)
+
+	Info(context.Background(), "address generated", "user", 12, "addr", "1abc def")
+	Errorf(context.Background(), "failed %d times", 3)
+
+	if len(rec.records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", len(rec.records))
+	}
+	line := FormatRecord(rec.records[0], nil, "")
+	if !strings.Contains(line, "Log_test.go:") {
+		t.Errorf("Caller not reported - %v", line)
+	}
+	if !strings.HasSuffix(line, ` - address generated user=12 addr="1abc def"`) {
+		t.Errorf("Invalid formatting - %v", line)
+	}
+	if rec.records[1].Level != LevelError || rec.records[1].Message != "failed 3 times" {
+		t.Errorf("Invalid record - %v", rec.records[1])
+	}
+}
+
+func TestContextFields(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(10)
+	SetSinks(sink)
+	defer SetSinks(old...)
+
+	c := WithRequestID(context.Background(), "req1")
+	c = WithFields(c, "user", "u1")
+	c2 := WithFields(c, "user", "u2", "page", 3)
+	Infof(c, "first")
+	Info(c2, "second")
+
+	entries := sink.Entries()
+	if v, _ := entries[0].Attr(RequestIDKey); v.String() != "req1" {
+		t.Errorf("Request ID not attached - %v", entries[0])
+	}
+	if v, _ := entries[0].Attr("user"); v.String() != "u1" {
+		t.Errorf("Field not attached - %v", entries[0])
+	}
+	if v, _ := entries[1].Attr("user"); v.String() != "u2" {
+		t.Errorf("Field not replaced - %v", entries[1])
+	}
+	if RequestID(c2) != "req1" || TraceID(c2) != "" {
+		t.Errorf("Invalid IDs in context")
+	}
+}
+
+func TestPackageLevels(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(10)
+	SetSinks(sink)
+	defer SetSinks(old...)
+	defer SetLevel(GetLevel())
+	defer ClearPackageLevel("Go/Log")
+
+	c := context.Background()
+	SetLevel(LevelWarning)
+	Infof(c, "dropped")
+	Warningf(c, "kept")
+	SetPackageLevel("Go/Log", LevelDebug)
+	Debugf(c, "kept by override")
+
+	entries := sink.Entries()
+	if len(entries) != 2 || entries[0].Message != "kept" || entries[1].Message != "kept by override" {
+		t.Errorf("Invalid entries - %v", entries)
+	}
+	if LevelForPackage("github.com/ThePiachu/Go/Log/sub") != LevelDebug {
+		t.Errorf("Override doesn't apply to sub-packages")
+	}
+	if LevelForPackage("github.com/ThePiachu/Go/mymath") != LevelWarning {
+		t.Errorf("Override applies to other packages")
+	}
+}
+
+func TestLevelsHandlerRequiresAdmin(t *testing.T) {
+	defer SetLevel(GetLevel())
+	SetLevel(LevelInfo)
+
+	w := httptest.NewRecorder()
+	LevelsHandler(w, httptest.NewRequest("POST", "/admin/log/levels?level=debug", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid status - %v", w.Code)
+	}
+	if GetLevel() != LevelInfo {
+		t.Errorf("Level changed by a non-admin")
+	}
+}
+
+func TestDeduplication(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(10)
+	SetSinks(sink)
+	defer SetSinks(old...)
+	SetDedupWindow(time.Hour)
+	defer SetDedupWindow(0)
+
+	c := context.Background()
+	for i := 0; i < 5; i++ {
+		Errorf(c, "same message")
+	}
+	FlushRepeated(c)
+
+	entries := sink.Entries()
+	if len(entries) != 2 || entries[0].Message != "same message" {
+		t.Fatalf("Invalid entries - %v", entries)
+	}
+	if v, _ := entries[1].Attr(RepeatedKey); v.Int64() != 4 {
+		t.Errorf("Invalid summary - %v", entries[1])
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(10)
+	SetSinks(sink)
+	defer SetSinks(old...)
+	SetRateLimit(0.001, 2)
+	defer SetRateLimit(0, 0)
+
+	c := context.Background()
+	for i := 0; i < 5; i++ {
+		Infof(c, "Trying %v", i)
+	}
+	Criticalf(c, "never limited")
+
+	entries := sink.Entries()
+	if len(entries) != 3 || entries[1].Message != "Trying 1" || entries[2].Message != "never limited" {
+		t.Errorf("Invalid entries - %v", entries)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(10)
+	SetSinks(sink)
+	defer SetSinks(old...)
+
+	type wallet struct {
+		Address    string
+		PrivateKey string `log:"secret"`
+	}
+	key := "18E14A7B6A307F426A94F8114701E7C8E774E7F9A47E2C2035DB29A206321725"
+	w := &wallet{Address: "1PMycacnJaSqwwJqjawXBErnLsZ7RkXUAs", PrivateKey: "secret value"}
+
+	c := context.Background()
+	Infof(c, "%v", w)
+	Info(c, "signing", "key", key, "wallet", w)
+	Infof(c, "seed snoPBrXtMeMyMHUVTgbuqAfg1SUTb")
+
+	entries := sink.Entries()
+	if entries[0].Message != "&{1PMycacnJaSqwwJqjawXBErnLsZ7RkXUAs [REDACTED]}" {
+		t.Errorf("Secret field not redacted - %v", entries[0].Message)
+	}
+	if v, _ := entries[1].Attr("key"); v.String() != RedactedValue {
+		t.Errorf("Hex key not redacted - %v", v)
+	}
+	if v, _ := entries[1].Attr("wallet"); v.Any().(*wallet).PrivateKey != RedactedValue {
+		t.Errorf("Secret attribute not redacted - %v", v)
+	}
+	if entries[2].Message != "seed [REDACTED]" {
+		t.Errorf("Seed not redacted - %v", entries[2].Message)
+	}
+
+	type account struct {
+		Name    string
+		seed    string `log:"secret"`
+		Wallets []wallet
+		ByName  map[string]*wallet
+	}
+	a := account{Name: "main", seed: "hidden", Wallets: []wallet{*w}, ByName: map[string]*wallet{"w": w}}
+	redacted := RedactValue(a).(account)
+	if redacted.seed != RedactedValue {
+		t.Errorf("Unexported secret not redacted - %v", redacted.seed)
+	}
+	if redacted.Wallets[0].PrivateKey != RedactedValue || redacted.ByName["w"].PrivateKey != RedactedValue {
+		t.Errorf("Secrets in slices and maps not redacted - %+v", redacted)
+	}
+	if a.seed != "hidden" || w.PrivateKey != "secret value" {
+		t.Errorf("Original value modified")
+	}
+
+	type envelope struct {
+		Payload interface{}
+	}
+	Infof(c, "%v", []interface{}{w})
+	Info(c, "sending", "data", map[string]interface{}{"a": w}, "envelope", envelope{*w})
+	entries = sink.Entries()
+	if strings.Contains(entries[3].Message, "secret value") {
+		t.Errorf("Secret in an interface slice not redacted - %v", entries[3].Message)
+	}
+	if v, _ := entries[4].Attr("data"); v.Any().(map[string]interface{})["a"].(*wallet).PrivateKey != RedactedValue {
+		t.Errorf("Secret in an interface map not redacted - %v", v)
+	}
+	if v, _ := entries[4].Attr("envelope"); v.Any().(envelope).Payload.(wallet).PrivateKey != RedactedValue {
+		t.Errorf("Secret in an interface field not redacted - %v", v)
+	}
+	if w.PrivateKey != "secret value" {
+		t.Errorf("Original value modified")
+	}
+
+	hash := "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b"
+	Infof(c, "tx %v key=%v", hash, key)
+	Info(c, "sent", "tx", hash)
+	entries = sink.Entries()
+	if entries[5].Message != "tx "+hash+" key=[REDACTED]" {
+		t.Errorf("Invalid hex redaction - %v", entries[3].Message)
+	}
+	if v, _ := entries[6].Attr("tx"); v.String() != hash {
+		t.Errorf("Transaction hash redacted - %v", v)
+	}
+	if w.PrivateKey != "secret value" {
+		t.Errorf("Original value modified")
+	}
+
+	SetRedaction(false)
+	defer SetRedaction(true)
+	if RedactString(key) != key {
+		t.Errorf("Redaction not disabled")
+	}
+}
+
+func logFromHelper(c context.Context) {
+	WithDepth(1).JInfof(c, "from helper %v", "value")
+}
+
+func TestWithDepth(t *testing.T) {
+	old := Sinks()
+	rec := new(recordingHandler)
+	SetSinks(rec)
+	defer SetSinks(old...)
+
+	c := context.Background()
+	logFromHelper(c)
+	WithDepth(0).Error(c, "direct")
+
+	if len(rec.records) != 2 {
+		t.Fatalf("Expected 2 records, got %v", len(rec.records))
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{rec.records[0].PC}).Next()
+	if frame.Function != "github.com/ThePiachu/Go/Log.TestWithDepth" {
+		t.Errorf("Helper reported as the caller - %v", frame.Function)
+	}
+	if rec.records[0].Message != `from helper "value"` {
+		t.Errorf("Invalid message - %v", rec.records[0].Message)
+	}
+	frame, _ = runtime.CallersFrames([]uintptr{rec.records[1].PC}).Next()
+	if frame.Function != "github.com/ThePiachu/Go/Log.TestWithDepth" {
+		t.Errorf("Invalid caller - %v", frame.Function)
+	}
+}
+
+func TestCallerFormat(t *testing.T) {
+	defer SetCallerFormat(GetCallerFormat())
+
+	var pcs [1]uintptr
+	runtime.Callers(1, pcs[:])
+	SetCallerFormat(CallerFormat{})
+	if caller := FormatCaller(pcs[0]); !strings.HasPrefix(caller, "/") || !strings.Contains(caller, "/Log/Log_test.go:") {
+		t.Errorf("Invalid full caller - %v", caller)
+	}
+	SetCallerFormat(CallerFormat{ShortPath: true, Function: true})
+	if caller := FormatCaller(pcs[0]); !strings.HasPrefix(caller, "Log/Log_test.go:") || !strings.HasSuffix(caller, " Log.TestCallerFormat") {
+		t.Errorf("Invalid short caller - %v", caller)
+	}
+}
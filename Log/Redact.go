@@ -0,0 +1,284 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/net/context"
+)
+
+// Secret redaction, on by default. Struct fields tagged `log:"secret"` are masked in
+// logged arguments and attributes, including unexported fields and structs held in
+// pointers, slices, maps and interface values. Anything looking like a WIF key or a Ripple seed is masked
+// in the final message and attributes, and so are 64 character hex strings given as a
+// key or secret ("key=...", "secret: ..." or an attribute named like one). Other hex
+// strings, like transaction hashes, are left as they are.
+// For local debugging it can be turned off with SetRedaction(false) or LOG_REDACT=off.
+
+const RedactedValue = "[REDACTED]"
+
+var redactionDisabled atomic.Bool
+
+// Hex private keys following a key-like name
+var hexKeyPattern = regexp.MustCompile(`(?i)\b(\w*(?:key|secret|seed)["']?\s*[=:]\s*["']?)[0-9a-f]{64}\b`)
+
+// Attribute names whose hex values are keys
+var secretNamePattern = regexp.MustCompile(`(?i)(key|secret|seed)$`)
+
+var hexKey = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+var secretPatterns = []*regexp.Regexp{
+	//WIF private keys - uncompressed and compressed, main net and test net
+	regexp.MustCompile(`\b[59][1-9A-HJ-NP-Za-km-z]{50}\b`),
+	regexp.MustCompile(`\b[KLc][1-9A-HJ-NP-Za-km-z]{51}\b`),
+	//Ripple master seeds
+	regexp.MustCompile(`\bs[rpshnaf39wBUDNEGHJKLM4PQRST7VWXYZ2bcdeCg65jkm8oFqi1tuvAxyz]{28}\b`),
+}
+
+// Caches whether a struct type has secret fields
+var secretTypes sync.Map
+
+func init() {
+	switch strings.ToLower(os.Getenv("LOG_REDACT")) {
+	case "off", "false", "0":
+		SetRedaction(false)
+	}
+}
+
+func SetRedaction(enabled bool) {
+	redactionDisabled.Store(!enabled)
+}
+
+func IsRedactionEnabled() bool {
+	return !redactionDisabled.Load()
+}
+
+// Masks every substring that looks like a private key or a seed
+func RedactString(s string) string {
+	if !IsRedactionEnabled() {
+		return s
+	}
+	s = hexKeyPattern.ReplaceAllString(s, "${1}"+RedactedValue)
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllLiteralString(s, RedactedValue)
+	}
+	return s
+}
+
+// Masks the string value of an attribute, treating hex values of key-like names as keys
+func redactNamedString(name, s string) string {
+	if IsRedactionEnabled() && secretNamePattern.MatchString(name) && hexKey.MatchString(s) {
+		return RedactedValue
+	}
+	return RedactString(s)
+}
+
+// Returns a copy of a struct - or of a pointer, slice, array, map or interface holding
+// structs - with the fields tagged `log:"secret"` masked. Other values are returned as they are.
+func RedactValue(v interface{}) interface{} {
+	if v == nil || !IsRedactionEnabled() {
+		return v
+	}
+	rv := reflect.ValueOf(v)
+	if !hasSecrets(rv.Type()) {
+		return v
+	}
+	return redactValue(rv, 0).Interface()
+}
+
+func redactArgs(args []interface{}) []interface{} {
+	if !IsRedactionEnabled() {
+		return args
+	}
+	answer := make([]interface{}, len(args))
+	for i, arg := range args {
+		answer[i] = RedactValue(arg)
+	}
+	return answer
+}
+
+func isSecretField(f reflect.StructField) bool {
+	for _, option := range strings.Split(f.Tag.Get("log"), ",") {
+		if option == "secret" {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether values of the type can hold secret fields
+func hasSecrets(t reflect.Type) bool {
+	if answer, ok := secretTypes.Load(t); ok {
+		return answer.(bool)
+	}
+	answer := typeHasSecrets(t, map[reflect.Type]bool{})
+	secretTypes.Store(t, answer)
+	return answer
+}
+
+func typeHasSecrets(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		//Only the dynamic value tells, so redactValue looks inside
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHasSecrets(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if isSecretField(f) || typeHasSecrets(f.Type, visiting) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Deeper values are dropped, so that cyclic data can't loop forever
+const maxRedactDepth = 32
+
+// Returns a copy of the value with the secret fields masked
+func redactValue(v reflect.Value, depth int) reflect.Value {
+	if depth > maxRedactDepth {
+		return reflect.Zero(v.Type())
+	}
+	if !hasSecrets(v.Type()) {
+		return v
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return redactStruct(v, depth)
+	case reflect.Interface:
+		if v.IsNil() || !hasSecrets(v.Elem().Type()) {
+			return v
+		}
+		answer := reflect.New(v.Type()).Elem()
+		answer.Set(redactValue(v.Elem(), depth+1))
+		return answer
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(redactValue(v.Elem(), depth+1))
+		return p
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		answer := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			answer.Index(i).Set(redactValue(v.Index(i), depth+1))
+		}
+		return answer
+	case reflect.Array:
+		answer := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			answer.Index(i).Set(redactValue(v.Index(i), depth+1))
+		}
+		return answer
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		answer := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			answer.SetMapIndex(iter.Key(), redactValue(iter.Value(), depth+1))
+		}
+		return answer
+	}
+	return v
+}
+
+func redactStruct(v reflect.Value, depth int) reflect.Value {
+	t := v.Type()
+	answer := reflect.New(t).Elem()
+	answer.Set(v)
+	for i := 0; i < t.NumField(); i++ {
+		field := answer.Field(i)
+		if !field.CanSet() {
+			//Unexported fields of the copy are only reachable through their address
+			field = reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem()
+		}
+		switch {
+		case isSecretField(t.Field(i)):
+			if field.Kind() == reflect.String {
+				field.SetString(RedactedValue)
+			} else {
+				field.Set(reflect.Zero(field.Type()))
+			}
+		case hasSecrets(field.Type()):
+			field.Set(redactValue(field, depth+1))
+		}
+	}
+	return answer
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactNamedString(a.Key, a.Value.String()))
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, ga := range group {
+			redacted[i] = redactAttr(ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+	case slog.KindAny, slog.KindLogValuer:
+		v := RedactValue(a.Value.Resolve().Any())
+		if s, ok := v.(string); ok {
+			v = redactNamedString(a.Key, s)
+		}
+		a.Value = slog.AnyValue(v)
+	}
+	return a
+}
+
+// Masks secrets in the message and attributes of the records
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h *redactHandler) Enabled(c context.Context, level slog.Level) bool {
+	return h.next.Enabled(c, level)
+}
+
+func (h *redactHandler) Handle(c context.Context, r slog.Record) error {
+	if !IsRedactionEnabled() {
+		return h.next.Handle(c, r)
+	}
+	redacted := slog.NewRecord(r.Time, r.Level, RedactString(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(c, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,376 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+)
+
+// Sinks are slog.Handlers that receive every log line. By default the package logs
+// through App Engine when running on it and to stderr otherwise; LOG_SINK overrides that:
+//
+//	LOG_SINK=appengine
+//	LOG_SINK=stderr
+//	LOG_SINK=json:/var/log/app.log   (rotated by LOG_FILE_MAX_SIZE bytes, keeping LOG_FILE_MAX_BACKUPS files)
+//	LOG_SINK=memory
+//
+// Several sinks can be given separated by commas.
+
+var sinks struct {
+	sync.RWMutex
+	list    []slog.Handler
+	handler slog.Handler
+	//The part of the pipeline after deduplication, for writing the "repeated" summaries
+	afterLimits slog.Handler
+}
+
+func init() {
+	if err := ConfigureFromEnv(); err != nil {
+		fmt.Fprintf(os.Stderr, "Log - %v\n", err)
+		SetSinks(DefaultSink())
+	}
+}
+
+// Returns the handler every log line goes through, so the package can be used as a
+// backend for slog: slog.New(Log.Handler()).InfoContext(c, "msg", "key", value)
+func Handler() slog.Handler {
+	sinks.RLock()
+	defer sinks.RUnlock()
+	return sinks.handler
+}
+
+// Replaces all the sinks
+func SetSinks(list ...slog.Handler) {
+	sinks.Lock()
+	defer sinks.Unlock()
+	sinks.list = append([]slog.Handler{}, list...)
+	sinks.handler, sinks.afterLimits = buildPipeline(sinks.list)
+}
+
+// Adds a sink next to the ones already configured
+func AddSink(h slog.Handler) {
+	sinks.Lock()
+	defer sinks.Unlock()
+	sinks.list = append(append([]slog.Handler{}, sinks.list...), h)
+	sinks.handler, sinks.afterLimits = buildPipeline(sinks.list)
+}
+
+// Returns the configured sinks
+func Sinks() []slog.Handler {
+	sinks.RLock()
+	defer sinks.RUnlock()
+	return append([]slog.Handler{}, sinks.list...)
+}
+
+// App Engine when running on it, stderr otherwise
+func DefaultSink() slog.Handler {
+	if appengine.IsAppEngine() {
+		return NewAppEngineHandler()
+	}
+	return NewTextSink(os.Stderr)
+}
+
+// Configures the sinks from the LOG_SINK, LOG_FILE_MAX_SIZE and LOG_FILE_MAX_BACKUPS
+// environment variables. Called on startup.
+func ConfigureFromEnv() error {
+	spec := os.Getenv("LOG_SINK")
+	if spec == "" {
+		SetSinks(DefaultSink())
+		return nil
+	}
+	maxSize, err := envInt("LOG_FILE_MAX_SIZE", 10<<20)
+	if err != nil {
+		return err
+	}
+	maxBackups, err := envInt("LOG_FILE_MAX_BACKUPS", 5)
+	if err != nil {
+		return err
+	}
+
+	list := []slog.Handler{}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "appengine":
+			list = append(list, NewAppEngineHandler())
+		case name == "stderr":
+			list = append(list, NewTextSink(os.Stderr))
+		case name == "memory":
+			list = append(list, NewMemorySink(1000))
+		case strings.HasPrefix(name, "json:"):
+			sink, err := NewJSONFileSink(strings.TrimPrefix(name, "json:"), int64(maxSize), maxBackups)
+			if err != nil {
+				return err
+			}
+			list = append(list, sink)
+		default:
+			return errors.New("unknown LOG_SINK " + name)
+		}
+	}
+	SetSinks(list...)
+	return nil
+}
+
+func envInt(name string, def int) (int, error) {
+	s := os.Getenv(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s - %v", name, err)
+	}
+	return i, nil
+}
+
+// Wraps the sinks in the handlers processing every record before it is written.
+// Returns the whole pipeline and the part of it after deduplication.
+func buildPipeline(list []slog.Handler) (slog.Handler, slog.Handler) {
+	var h slog.Handler = NewMultiHandler(list...)
+	h = &redactHandler{next: h}
+	h = &contextHandler{next: h}
+	afterLimits := h
+	h = &limitHandler{next: h}
+	h = &levelHandler{next: h}
+	return newCaptureHandler(h), afterLimits
+}
+
+// Fans records out to several handlers
+type MultiHandler struct {
+	handlers []slog.Handler
+}
+
+func NewMultiHandler(handlers ...slog.Handler) *MultiHandler {
+	return &MultiHandler{handlers: handlers}
+}
+
+func (m *MultiHandler) Enabled(c context.Context, level slog.Level) bool {
+	for _, h := range m.handlers {
+		if h.Enabled(c, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MultiHandler) Handle(c context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range m.handlers {
+		if !h.Enabled(c, r.Level) {
+			continue
+		}
+		if err := h.Handle(c, r.Clone()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m *MultiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, len(m.handlers))
+	for i, h := range m.handlers {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return NewMultiHandler(handlers...)
+}
+
+func (m *MultiHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, len(m.handlers))
+	for i, h := range m.handlers {
+		handlers[i] = h.WithGroup(name)
+	}
+	return NewMultiHandler(handlers...)
+}
+
+// Prints the level under the package's names and the source according to the caller format
+func replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(LevelName(level))
+		}
+	case slog.SourceKey:
+		if source, ok := a.Value.Any().(*slog.Source); ok {
+			a.Value = slog.StringValue(formatFrame(source.File, source.Line, source.Function))
+		}
+	}
+	return a
+}
+
+func sinkOptions() *slog.HandlerOptions {
+	return &slog.HandlerOptions{AddSource: true, Level: LevelDebug, ReplaceAttr: replaceAttr}
+}
+
+// Writes logfmt style lines to w
+func NewTextSink(w io.Writer) slog.Handler {
+	return slog.NewTextHandler(w, sinkOptions())
+}
+
+// Writes one JSON object per line to w
+func NewJSONSink(w io.Writer) slog.Handler {
+	return slog.NewJSONHandler(w, sinkOptions())
+}
+
+// A JSON lines sink writing to a size rotated file
+type FileSink struct {
+	slog.Handler
+	File *RotatingFile
+}
+
+func NewJSONFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	f, err := OpenRotatingFile(path, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{Handler: NewJSONSink(f), File: f}, nil
+}
+
+func (f *FileSink) Close() error {
+	return f.File.Close()
+}
+
+// A single log line as kept by the in-memory sink
+type Entry struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Attrs   []slog.Attr
+	Caller  string
+}
+
+// Flattens the record and the handler attributes into an Entry
+func NewEntry(r slog.Record, attrs []slog.Attr, group string) Entry {
+	e := Entry{Time: r.Time, Level: r.Level, Message: r.Message, Caller: CallerLocation(r)}
+	e.Attrs = append(e.Attrs, attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if group != "" {
+			a.Key = group + a.Key
+		}
+		e.Attrs = append(e.Attrs, a)
+		return true
+	})
+	return e
+}
+
+// Returns the value of the first attribute with the given key
+func (e Entry) Attr(key string) (slog.Value, bool) {
+	for _, a := range e.Attrs {
+		if a.Key == key {
+			return a.Value, true
+		}
+	}
+	return slog.Value{}, false
+}
+
+func (e Entry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Caller)
+	b.WriteString(" - ")
+	b.WriteString(e.Message)
+	for _, a := range e.Attrs {
+		appendAttr(&b, "", a)
+	}
+	return b.String()
+}
+
+// Keeps the last entries in memory, dropping the oldest ones once the buffer is full
+type MemorySink struct {
+	buffer *entryBuffer
+	attrs  []slog.Attr
+	group  string
+}
+
+type entryBuffer struct {
+	sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+}
+
+func NewMemorySink(size int) *MemorySink {
+	if size <= 0 {
+		size = 1
+	}
+	return &MemorySink{buffer: &entryBuffer{entries: make([]Entry, size)}}
+}
+
+func (m *MemorySink) Enabled(c context.Context, level slog.Level) bool {
+	return true
+}
+
+func (m *MemorySink) Handle(c context.Context, r slog.Record) error {
+	m.buffer.add(NewEntry(r, m.attrs, m.group))
+	return nil
+}
+
+func (m *MemorySink) WithAttrs(attrs []slog.Attr) slog.Handler {
+	m2 := *m
+	m2.attrs = append([]slog.Attr{}, m.attrs...)
+	for _, a := range attrs {
+		a.Key = m.group + a.Key
+		m2.attrs = append(m2.attrs, a)
+	}
+	return &m2
+}
+
+func (m *MemorySink) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return m
+	}
+	m2 := *m
+	m2.group = m.group + name + "."
+	return &m2
+}
+
+// Returns the stored entries, oldest first
+func (m *MemorySink) Entries() []Entry {
+	return m.buffer.all()
+}
+
+func (m *MemorySink) Reset() {
+	m.buffer.reset()
+}
+
+func (b *entryBuffer) add(e Entry) {
+	b.Lock()
+	defer b.Unlock()
+	b.entries[b.next] = e
+	b.next++
+	if b.next == len(b.entries) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+func (b *entryBuffer) all() []Entry {
+	b.Lock()
+	defer b.Unlock()
+	if !b.full {
+		return append([]Entry{}, b.entries[:b.next]...)
+	}
+	return append(append([]Entry{}, b.entries[b.next:]...), b.entries[:b.next]...)
+}
+
+func (b *entryBuffer) reset() {
+	b.Lock()
+	defer b.Unlock()
+	b.entries = make([]Entry, len(b.entries))
+	b.next = 0
+	b.full = false
+}
@@ -0,0 +1,142 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestMemorySink(t *testing.T) {
+	old := Sinks()
+	sink := NewMemorySink(2)
+	SetSinks(sink)
+	defer SetSinks(old...)
+
+	c := context.Background()
+	Infof(c, "first")
+	Warning(c, "second", "key", "value")
+	Errorf(c, "third")
+
+	entries := sink.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v", len(entries))
+	}
+	if entries[0].Message != "second" || entries[1].Message != "third" {
+		t.Errorf("Invalid entries - %v", entries)
+	}
+	if v, ok := entries[0].Attr("key"); !ok || v.String() != "value" {
+		t.Errorf("Attribute not stored - %v", entries[0])
+	}
+	if !strings.Contains(entries[1].Caller, "Sinks_test.go:") {
+		t.Errorf("Invalid caller - %v", entries[1].Caller)
+	}
+}
+
+func TestMemorySinkGroups(t *testing.T) {
+	sink := NewMemorySink(10)
+	slog.New(sink).WithGroup("request").With("id", 7).Info("done", "status", 200)
+
+	entries := sink.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %v", len(entries))
+	}
+	if v, ok := entries[0].Attr("request.id"); !ok || v.Int64() != 7 {
+		t.Errorf("Group missing from a With attribute - %v", entries[0].Attrs)
+	}
+	if v, ok := entries[0].Attr("request.status"); !ok || v.Int64() != 200 {
+		t.Errorf("Group missing from a record attribute - %v", entries[0].Attrs)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	old := Sinks()
+	var buf bytes.Buffer
+	SetSinks(NewJSONSink(&buf))
+	defer SetSinks(old...)
+
+	Criticalf(context.Background(), "value %d", 5)
+
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if line["level"] != "CRITICAL" || line["msg"] != "value 5" {
+		t.Errorf("Invalid line - %v", line)
+	}
+	if !strings.Contains(line["source"].(string), "Sinks_test.go:") {
+		t.Errorf("Invalid source - %v", line["source"])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	expected := map[string]string{path: "dddddddd\n", path + ".1": "cccccccc\n", path + ".2": "bbbbbbbb\n"}
+	for name, content := range expected {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("Invalid content of %v - %q", name, data)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Too many backups kept")
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	//A non-empty directory in place of the backup makes the rename fail
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	f, err := OpenRotatingFile(path, 10, 1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write([]byte("aaaaaaaa\n")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	n, err := f.Write([]byte("bbbbbbbb\n"))
+	if err == nil {
+		t.Errorf("Expected the rotation error")
+	}
+	if n != 9 {
+		t.Errorf("Write after a failed rotation wrote %v bytes", n)
+	}
+	if _, err := f.Write([]byte("cccccccc\n")); err == nil {
+		t.Errorf("Expected the rotation to be retried and fail again")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(data) != "aaaaaaaa\nbbbbbbbb\ncccccccc\n" {
+		t.Errorf("Invalid content - %q", data)
+	}
+}
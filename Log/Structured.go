@@ -0,0 +1,33 @@
+package Log
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"golang.org/x/net/context"
+)
+
+// Structured logging. args are alternating keys and values, or slog.Attr values:
+//
+//	Log.Info(c, "address generated", "user", id, "addr", a)
+
+func Debug(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelDebug, 1, msg, args...)
+}
+
+func Info(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelInfo, 1, msg, args...)
+}
+
+func Warning(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelWarning, 1, msg, args...)
+}
+
+func Error(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelError, 1, msg, args...)
+}
+
+func Critical(c context.Context, msg string, args ...interface{}) {
+	output(c, LevelCritical, 1, msg, args...)
+}
@@ -0,0 +1,355 @@
+package LogStore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//Package for keeping the lines logged through the Log package in datastore and browsing them.
+//
+//	LogStore.Enable(Log.LevelInfo, 7*24*time.Hour)
+//	LogStore.Mount("/admin/logs")
+//
+// Mount it under a path only admins can reach (login: admin in app.yaml); the handlers
+// check for an admin as well, and let cron run the cleanup.
+// Lines are buffered in memory and written in batches in the background, so logging
+// doesn't wait for datastore; call LogStore.Flush(c) before an instance shuts down.
+// Lines logged while not running on App Engine are dropped.
+// Expired entries are removed by the cleanup handler, meant to be run from cron
+// ("/admin/logs/cleanup" for the example above). Expires can also be used as the
+// field of a datastore TTL policy.
+//
+// Filtering by request ID needs a composite index:
+//
+//	- kind: LogEntry
+//	  properties:
+//	  - name: RequestID
+//	  - name: Time
+//	    direction: desc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThePiachu/Go/Datastore"
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+const LogEntryKind = "LogEntry"
+
+// Entries scanned for one page when filtering by level or text, which datastore can't do
+const MaxScannedPerPage = 1000
+
+// Entries deleted by one cleanup run
+const MaxDeletedPerCleanup = 10000
+
+// Entries kept in memory waiting to be written; lines logged while the buffer is full are dropped
+const MaxBufferedEntries = 5000
+
+// How often the buffered entries are written
+const DefaultFlushInterval = 5 * time.Second
+
+// Replaced in tests
+var isAppEngine = appengine.IsAppEngine
+var putMulti = datastore.PutMulti
+
+type LogEntry struct {
+	Time      time.Time
+	Level     int64
+	Message   string `datastore:",noindex"`
+	Caller    string `datastore:",noindex"`
+	RequestID string
+	TraceID   string `datastore:",noindex"`
+	//The remaining attributes as key=value pairs
+	Attrs   string `datastore:",noindex"`
+	Expires time.Time
+}
+
+func (e *LogEntry) LevelName() string {
+	return Log.LevelName(slog.Level(e.Level))
+}
+
+type contextKey int
+
+// Marks the contexts used by the store itself, so errors logged while writing entries
+// don't feed back into it
+const internalContextKey contextKey = 0
+
+var enabled struct {
+	sync.Once
+	sink atomic.Pointer[Sink]
+}
+
+// Starts storing the lines at minLevel and above, kept for ttl, by adding a sink to the
+// Log package. Call it after the sinks are configured, as Log.SetSinks removes it.
+func Enable(minLevel slog.Level, ttl time.Duration) {
+	enabled.Do(func() {
+		sink := NewSink(minLevel, ttl)
+		enabled.sink.Store(sink)
+		Log.AddSink(sink)
+	})
+}
+
+// Writes the lines buffered by the sink added by Enable
+func Flush(c context.Context) error {
+	sink := enabled.sink.Load()
+	if sink == nil {
+		return nil
+	}
+	return sink.Flush(c)
+}
+
+// A slog.Handler storing the records in datastore. Records are buffered and written in
+// batches every DefaultFlushInterval or once a full batch is waiting.
+// Records logged while not running on App Engine are dropped.
+type Sink struct {
+	MinLevel slog.Level
+	TTL      time.Duration
+	attrs    []slog.Attr
+	group    string
+	buffer   *entryBuffer
+}
+
+// The entries waiting to be written, shared by a sink and the sinks derived from it
+type entryBuffer struct {
+	mutex   sync.Mutex
+	entries []*LogEntry
+	dropped int
+	full    chan struct{}
+}
+
+// Creates a sink and starts its background flushing
+func NewSink(minLevel slog.Level, ttl time.Duration) *Sink {
+	s := &Sink{MinLevel: minLevel, TTL: ttl, buffer: &entryBuffer{full: make(chan struct{}, 1)}}
+	go s.run(DefaultFlushInterval)
+	return s
+}
+
+func (s *Sink) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	//Not tied to a request, so it stays valid after the one that logged the lines ends
+	c := appengine.BackgroundContext()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.buffer.full:
+		}
+		s.Flush(c)
+	}
+}
+
+func (s *Sink) Enabled(c context.Context, level slog.Level) bool {
+	return level >= s.MinLevel
+}
+
+func (s *Sink) Handle(c context.Context, r slog.Record) error {
+	if c == nil || c.Value(internalContextKey) != nil || !isAppEngine() {
+		return nil
+	}
+	entry := NewLogEntry(Log.NewEntry(r, s.attrs, s.group), s.TTL)
+
+	b := s.buffer
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.entries) >= MaxBufferedEntries {
+		b.dropped++
+		return nil
+	}
+	b.entries = append(b.entries, entry)
+	if len(b.entries) >= Datastore.MaxPutMultiSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Writes the buffered entries to datastore. Entries that fail to be written are dropped.
+func (s *Sink) Flush(c context.Context) error {
+	b := s.buffer
+	b.mutex.Lock()
+	entries, dropped := b.entries, b.dropped
+	b.entries, b.dropped = nil, 0
+	b.mutex.Unlock()
+
+	//Errors are written to stderr, as logging them would come back here
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "LogStore - buffer full, dropped %v lines\n", dropped)
+	}
+	c = context.WithValue(c, internalContextKey, true)
+	var errs []error
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > Datastore.MaxPutMultiSize {
+			n = Datastore.MaxPutMultiSize
+		}
+		keys := make([]*datastore.Key, n)
+		for i := range keys {
+			keys[i] = datastore.NewIncompleteKey(c, LogEntryKind, nil)
+		}
+		if _, err := putMulti(c, keys, entries[:n]); err != nil {
+			fmt.Fprintf(os.Stderr, "LogStore - %v\n", err)
+			errs = append(errs, err)
+		}
+		entries = entries[n:]
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Sink) WithAttrs(attrs []slog.Attr) slog.Handler {
+	s2 := *s
+	s2.attrs = append([]slog.Attr{}, s.attrs...)
+	for _, a := range attrs {
+		a.Key = s.group + a.Key
+		s2.attrs = append(s2.attrs, a)
+	}
+	return &s2
+}
+
+func (s *Sink) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return s
+	}
+	s2 := *s
+	s2.group = s.group + name + "."
+	return &s2
+}
+
+// Converts a log line to the stored form, moving the request and trace IDs out of the attributes
+func NewLogEntry(e Log.Entry, ttl time.Duration) *LogEntry {
+	entry := &LogEntry{
+		Time:    e.Time,
+		Level:   int64(e.Level),
+		Message: e.Message,
+		Caller:  e.Caller,
+		Expires: e.Time.Add(ttl),
+	}
+	attrs := []string{}
+	for _, a := range e.Attrs {
+		switch a.Key {
+		case Log.RequestIDKey:
+			entry.RequestID = a.Value.String()
+		case Log.TraceIDKey:
+			entry.TraceID = a.Value.String()
+		default:
+			value := a.Value.Resolve().String()
+			if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+				value = strconv.Quote(value)
+			}
+			attrs = append(attrs, a.Key+"="+value)
+		}
+	}
+	entry.Attrs = strings.Join(attrs, " ")
+	return entry
+}
+
+// Selects the entries to list. Zero values match everything.
+type Filter struct {
+	MinLevel  slog.Level
+	From      time.Time
+	To        time.Time
+	RequestID string
+	//Case insensitive text looked for in the message, caller and attributes
+	Text string
+}
+
+func (f Filter) Matches(e *LogEntry) bool {
+	if slog.Level(e.Level) < f.MinLevel {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	if f.RequestID != "" && e.RequestID != f.RequestID {
+		return false
+	}
+	if f.Text != "" {
+		text := strings.ToLower(f.Text)
+		if !strings.Contains(strings.ToLower(e.Message), text) &&
+			!strings.Contains(strings.ToLower(e.Caller), text) &&
+			!strings.Contains(strings.ToLower(e.Attrs), text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns up to limit entries matching the filter, newest first, starting at the cursor
+// returned for the previous page. The returned cursor is empty on the last page.
+// Level and text are filtered in memory, so a page can come back short when few entries
+// match; the cursor then continues after the scanned ones.
+func QueryLogEntries(c context.Context, filter Filter, cursor string, limit int) ([]*LogEntry, string, error) {
+	q := datastore.NewQuery(LogEntryKind).Order("-Time")
+	if !filter.From.IsZero() {
+		q = q.Filter("Time >=", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Filter("Time <", filter.To)
+	}
+	if filter.RequestID != "" {
+		q = q.Filter("RequestID =", filter.RequestID)
+	}
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(start)
+	}
+
+	answer := []*LogEntry{}
+	t := q.Run(c)
+	for scanned := 0; len(answer) < limit && scanned < MaxScannedPerPage; scanned++ {
+		entry := new(LogEntry)
+		_, err := t.Next(entry)
+		if errors.Is(err, datastore.Done) {
+			return answer, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if filter.Matches(entry) {
+			answer = append(answer, entry)
+		}
+	}
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return answer, next.String(), nil
+}
+
+// Deletes up to MaxDeletedPerCleanup expired entries, returning how many were removed
+func Cleanup(c context.Context) (int, error) {
+	keys, err := datastore.NewQuery(LogEntryKind).Filter("Expires <", time.Now()).KeysOnly().Limit(MaxDeletedPerCleanup).GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > Datastore.MaxPutMultiSize {
+			n = Datastore.MaxPutMultiSize
+		}
+		if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+			return deleted, err
+		}
+		deleted += n
+		keys = keys[n:]
+	}
+	return deleted, nil
+}
@@ -0,0 +1,99 @@
+package LogStore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/v2/datastore"
+)
+
+func TestNewLogEntry(t *testing.T) {
+	now := time.Now()
+	e := Log.Entry{
+		Time:    now,
+		Level:   Log.LevelWarning,
+		Message: "Payment failed",
+		Caller:  "/src/app/payments.go:42",
+		Attrs: []slog.Attr{
+			slog.String(Log.RequestIDKey, "req1"),
+			slog.String("user", "u1"),
+			slog.String("reason", "card declined"),
+		},
+	}
+	entry := NewLogEntry(e, time.Hour)
+	if entry.RequestID != "req1" || entry.Attrs != `user=u1 reason="card declined"` {
+		t.Errorf("Invalid entry - %+v", entry)
+	}
+	if !entry.Expires.Equal(now.Add(time.Hour)) || entry.LevelName() != "WARNING" {
+		t.Errorf("Invalid entry - %+v", entry)
+	}
+
+	filters := map[string]Filter{
+		"level":        {MinLevel: Log.LevelError},
+		"request":      {RequestID: "req2"},
+		"text":         {Text: "refund"},
+		"before range": {From: now.Add(time.Minute)},
+		"after range":  {To: now},
+	}
+	for name, filter := range filters {
+		if filter.Matches(entry) {
+			t.Errorf("Filter %v matches", name)
+		}
+	}
+	if !(Filter{MinLevel: Log.LevelWarning, RequestID: "req1", Text: "DECLINED", To: now.Add(time.Second)}).Matches(entry) {
+		t.Errorf("Filter doesn't match")
+	}
+}
+
+func TestSinkBuffering(t *testing.T) {
+	t.Setenv("GAE_APPLICATION", "s~test")
+	oldIsAppEngine, oldPutMulti := isAppEngine, putMulti
+	defer func() { isAppEngine, putMulti = oldIsAppEngine, oldPutMulti }()
+	written := 0
+	putMulti = func(c context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+		if c.Value(internalContextKey) == nil {
+			t.Errorf("Entries written with a context that isn't marked internal")
+		}
+		written += len(src.([]*LogEntry))
+		return keys, nil
+	}
+
+	s := NewSink(Log.LevelInfo, time.Hour)
+	c := context.Background()
+	isAppEngine = func() bool { return false }
+	s.Handle(c, slog.NewRecord(time.Now(), Log.LevelInfo, "dropped", 0))
+	isAppEngine = func() bool { return true }
+	s.WithAttrs([]slog.Attr{slog.String("user", "u1")}).Handle(c, slog.NewRecord(time.Now(), Log.LevelInfo, "kept", 0))
+	s.Handle(c, slog.NewRecord(time.Now(), Log.LevelError, "kept", 0))
+	if written != 0 {
+		t.Errorf("Entries written before flushing")
+	}
+	if err := s.Flush(c); err != nil {
+		t.Errorf("%v", err)
+	}
+	if written != 2 {
+		t.Errorf("Invalid number of entries written - %v", written)
+	}
+}
+
+func TestHandlersRequireAdmin(t *testing.T) {
+	w := httptest.NewRecorder()
+	ViewerHandler(w, httptest.NewRequest("GET", "/admin/logs", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid viewer status - %v", w.Code)
+	}
+	w = httptest.NewRecorder()
+	CleanupHandler(w, httptest.NewRequest("GET", "/admin/logs/cleanup", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Invalid cleanup status - %v", w.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package LogStore
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThePiachu/Go/Log"
+	"github.com/ThePiachu/Go/web"
+	appengine "google.golang.org/appengine/v2"
+	"google.golang.org/appengine/v2/user"
+)
+
+const DefaultPageSize = 100
+const MaxPageSize = 1000
+
+// Format of the from and to parameters, besides RFC 3339
+const timeInputFormat = "2006-01-02T15:04"
+
+// Mounts the viewer at path and the cleanup handler at path+"/cleanup" on web.Mux
+func Mount(path string) {
+	path = strings.TrimSuffix(path, "/")
+	web.Mux.HandleFunc(path, ViewerHandler)
+	web.Mux.HandleFunc(path+"/cleanup", CleanupHandler)
+}
+
+// Reads the filter from the level, from, to, request and q parameters
+func ParseFilter(r *http.Request) (Filter, error) {
+	filter := Filter{
+		RequestID: strings.TrimSpace(r.FormValue("request")),
+		Text:      strings.TrimSpace(r.FormValue("q")),
+	}
+	if s := r.FormValue("level"); s != "" {
+		level, err := Log.ParseLevel(s)
+		if err != nil {
+			return filter, err
+		}
+		filter.MinLevel = level
+	} else {
+		filter.MinLevel = Log.LevelDebug
+	}
+	var err error
+	if filter.From, err = parseTime(r.FormValue("from")); err != nil {
+		return filter, err
+	}
+	if filter.To, err = parseTime(r.FormValue("to")); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(timeInputFormat, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
+
+type viewerPage struct {
+	Levels  []string
+	Level   string
+	From    string
+	To      string
+	Request string
+	Query   string
+	Entries []*LogEntry
+	Next    string
+	Error   string
+}
+
+var viewerTemplate = template.Must(template.New("viewer").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05.000") },
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Logs</title>
+<style>
+body{font-family:monospace;font-size:13px}
+table{border-collapse:collapse;width:100%}
+td,th{border-bottom:1px solid #ddd;padding:2px 6px;text-align:left;vertical-align:top}
+.WARNING{background:#fff6d5}.ERROR{background:#fde0e0}.CRITICAL{background:#f8b4b4}
+.attrs{color:#666}
+</style></head><body>
+<form method="get">
+<select name="level">{{range .Levels}}<option{{if eq . $.Level}} selected{{end}}>{{.}}</option>{{end}}</select>
+from <input type="datetime-local" name="from" value="{{.From}}">
+to <input type="datetime-local" name="to" value="{{.To}}">
+request <input name="request" value="{{.Request}}">
+text <input name="q" value="{{.Query}}">
+<input type="submit" value="Filter">
+</form>
+{{if .Error}}<p class="ERROR">{{.Error}}</p>{{end}}
+<table>
+<tr><th>Time (UTC)</th><th>Level</th><th>Caller</th><th>Message</th><th>Request</th></tr>
+{{range .Entries}}<tr class="{{.LevelName}}"><td>{{time .Time}}</td><td>{{.LevelName}}</td><td>{{.Caller}}</td>
+<td>{{.Message}}{{if .Attrs}}<div class="attrs">{{.Attrs}}</div>{{end}}</td>
+<td>{{if .RequestID}}<a href="?request={{.RequestID}}">{{.RequestID}}</a>{{end}}</td></tr>
+{{else}}<tr><td colspan="5">No entries</td></tr>{{end}}
+</table>
+{{if .Next}}<p><a href="{{.Next}}">Older</a></p>{{end}}
+</body></html>
+`))
+
+// HTTP handler listing the stored entries, newest first. Takes the filter parameters
+// (level, from, to, request, q), cursor and limit. Responds with JSON for format=json.
+// Only admins can view the entries.
+func ViewerHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if !user.IsAdmin(c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	filter, err := ParseFilter(r)
+	if err != nil {
+		Log.Infof(c, "ViewerHandler - %v", err)
+		http.Error(w, "invalid filter", http.StatusBadRequest)
+		return
+	}
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	entries, cursor, err := QueryLogEntries(c, filter, r.FormValue("cursor"), limit)
+	if err != nil {
+		Log.Errorf(c, "ViewerHandler - %v", err)
+	}
+
+	if r.FormValue("format") == "json" {
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(struct {
+			Entries []*LogEntry
+			Cursor  string
+		}{entries, cursor})
+		return
+	}
+
+	page := viewerPage{
+		Levels:  []string{"DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL"},
+		Level:   Log.LevelName(filter.MinLevel),
+		From:    formatTimeInput(filter.From),
+		To:      formatTimeInput(filter.To),
+		Request: filter.RequestID,
+		Query:   filter.Text,
+		Entries: entries,
+	}
+	if err != nil {
+		page.Error = "Couldn't load the entries"
+	}
+	if cursor != "" {
+		params := url.Values{}
+		for key, values := range r.URL.Query() {
+			params[key] = values
+		}
+		params.Set("cursor", cursor)
+		page.Next = "?" + params.Encode()
+	}
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	if err := viewerTemplate.Execute(w, page); err != nil {
+		Log.Errorf(c, "ViewerHandler - %v", err)
+	}
+}
+
+func formatTimeInput(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(timeInputFormat)
+}
+
+// HTTP handler for cron, deleting the expired entries. Only cron and admins can run it.
+func CleanupHandler(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" && !user.IsAdmin(c) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	deleted, err := Cleanup(c)
+	if err != nil {
+		Log.Errorf(c, "CleanupHandler - %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Deleted %v entries", deleted)
+}
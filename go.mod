@@ -4,13 +4,11 @@ go 1.22.8
 
 require (
 	golang.org/x/net v0.30.0
+	golang.org/x/text v0.19.0
 	google.golang.org/appengine v1.6.8
 	google.golang.org/appengine/v2 v2.0.6
+	google.golang.org/protobuf v1.30.0
 	gopkg.in/inf.v0 v0.9.1
 )
 
-require (
-	github.com/golang/protobuf v1.5.2 // indirect
-	golang.org/x/text v0.19.0 // indirect
-	google.golang.org/protobuf v1.30.0 // indirect
-)
+require github.com/golang/protobuf v1.5.2 // indirect
@@ -14,7 +14,7 @@ import (
 
 type CoinAddress struct {
 	NetByte               string
-	PrivateKey            string
+	PrivateKey            string `log:"secret"`
 	PublicKeyCompressed   string
 	PublicKeyUncompressed string
 	AddressCompressed     string
@@ -0,0 +1,451 @@
+package mymath
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Email address parsing, following RFC 5322 with the UTF-8 addresses of RFC 6531:
+//
+//	ann@example.com
+//	"Ann Smith" <ann@example.com>
+//	Ann (work) <"ann smith"@example.com>
+//	=?utf-8?q?Zo=C3=AB?= <zoë@bücher.de>
+//	bob@[192.0.2.1]
+//
+// Internationalized domains are converted to ASCII with IDNA for sending.
+// Comments are skipped; groups and the obsolete syntax aren't supported.
+
+var ErrInvalidEmailAddress = errors.New("invalid email address")
+
+const (
+	maxLocalPartLength    = 64
+	maxDomainLength       = 253
+	maxEmailAddressLength = 254
+)
+
+type EmailAddress struct {
+	//Display name, decoded
+	Name string
+	//Local part, unquoted
+	LocalPart string
+	//Domain as written - a host name, possibly internationalized, or an address literal in []
+	Domain string
+	//Domain converted to ASCII
+	asciiDomain string
+}
+
+// Returns the bare address, local@domain
+func (a *EmailAddress) Address() string {
+	return quoteLocalPart(a.LocalPart) + "@" + a.Domain
+}
+
+// Returns the domain converted to ASCII, as used by SMTP and DNS
+func (a *EmailAddress) ASCIIDomain() string {
+	if a.asciiDomain == "" {
+		return a.Domain
+	}
+	return a.asciiDomain
+}
+
+// Returns the bare address with the domain converted to ASCII
+func (a *EmailAddress) ASCIIAddress() string {
+	return quoteLocalPart(a.LocalPart) + "@" + a.ASCIIDomain()
+}
+
+// Returns the address formatted for a mail header, with the display name encoded if needed
+func (a *EmailAddress) String() string {
+	//mail.Address quotes the local part itself
+	return (&mail.Address{Name: a.Name, Address: a.LocalPart + "@" + a.ASCIIDomain()}).String()
+}
+
+// Returns the form used to tell addresses apart - NFC normalized, lower case, with an
+// ASCII domain. Dots and +tags are kept, as providers differ in how they treat them.
+func (a *EmailAddress) Normalized() string {
+	local := strings.ToLower(norm.NFC.String(a.LocalPart))
+	return quoteLocalPart(local) + "@" + strings.ToLower(a.ASCIIDomain())
+}
+
+// Parses an address, with or without a display name
+func ParseEmailAddress(s string) (*EmailAddress, error) {
+	p := &emailAddressParser{s: s}
+	address, err := p.parseAddress()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+	if !p.empty() {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return address, nil
+}
+
+// Parses a comma separated list of addresses
+func ParseEmailAddressList(s string) ([]*EmailAddress, error) {
+	p := &emailAddressParser{s: s}
+	answer := []*EmailAddress{}
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if p.empty() {
+			return answer, nil
+		}
+		//Empty list elements are skipped
+		if p.consume(',') {
+			continue
+		}
+		address, err := p.parseAddress()
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, address)
+		if err := p.skipCFWS(); err != nil {
+			return nil, err
+		}
+		if !p.empty() && !p.consume(',') {
+			return nil, p.errorf("expected a comma, got %q", p.s[p.pos:])
+		}
+	}
+}
+
+// Returns the normalized form of the address, see EmailAddress.Normalized
+func NormalizeEmailAddress(s string) (string, error) {
+	address, err := ParseEmailAddress(s)
+	if err != nil {
+		return "", err
+	}
+	return address.Normalized(), nil
+}
+
+type emailAddressParser struct {
+	s   string
+	pos int
+	//Rejects whitespace, comments and folding instead of skipping them
+	bare bool
+}
+
+func (p *emailAddressParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w - %v", ErrInvalidEmailAddress, fmt.Sprintf(format, args...))
+}
+
+func (p *emailAddressParser) empty() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *emailAddressParser) peek() byte {
+	if p.empty() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *emailAddressParser) consume(b byte) bool {
+	if p.empty() || p.s[p.pos] != b {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+// Skips whitespace, folding and comments
+func (p *emailAddressParser) skipCFWS() error {
+	for !p.empty() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n', '(':
+			if p.bare {
+				return p.errorf("whitespace or comment in a bare address")
+			}
+		}
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '(':
+			if err := p.skipComment(); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *emailAddressParser) skipComment() error {
+	depth := 0
+	for !p.empty() {
+		switch p.peek() {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '\\':
+			p.pos++
+		}
+		p.pos++
+		if depth == 0 {
+			return nil
+		}
+	}
+	return p.errorf("unclosed comment")
+}
+
+func isAtext(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r >= utf8.RuneSelf:
+		//UTF-8 is allowed by RFC 6531
+		return r != utf8.RuneError
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+// Consumes a run of atext, with dots if dot is set
+func (p *emailAddressParser) consumeAtom(dot bool) string {
+	start := p.pos
+	for !p.empty() {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		if !isAtext(r) && !(dot && r == '.') {
+			break
+		}
+		p.pos += size
+	}
+	return p.s[start:p.pos]
+}
+
+func isDotAtom(s string) bool {
+	if s == "" || strings.HasPrefix(s, ".") || strings.HasSuffix(s, ".") || strings.Contains(s, "..") {
+		return false
+	}
+	for _, r := range s {
+		if !isAtext(r) && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the local part as it is if it's a dot-atom, and as a quoted string otherwise
+func quoteLocalPart(local string) string {
+	if isDotAtom(local) {
+		return local
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range local {
+		if r == '"' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Consumes a quoted string, returning its unquoted content
+func (p *emailAddressParser) consumeQuotedString() (string, error) {
+	if !p.consume('"') {
+		return "", p.errorf("expected a quoted string")
+	}
+	var b strings.Builder
+	for !p.empty() {
+		r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+		p.pos += size
+		switch {
+		case r == '"':
+			return b.String(), nil
+		case r == '\\':
+			if p.empty() {
+				return "", p.errorf("unclosed quoted string")
+			}
+			r, size = utf8.DecodeRuneInString(p.s[p.pos:])
+			p.pos += size
+		case r == '\r' || r == '\n':
+			if p.bare {
+				return "", p.errorf("folding in a bare address")
+			}
+			//Folding
+			continue
+		}
+		if r == utf8.RuneError || (r < ' ' && r != '\t') || r == 0x7f {
+			return "", p.errorf("invalid character in quoted string")
+		}
+		b.WriteRune(r)
+	}
+	return "", p.errorf("unclosed quoted string")
+}
+
+// Parses name-addr or addr-spec
+func (p *emailAddressParser) parseAddress() (*EmailAddress, error) {
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+	start := p.pos
+	if address, err := p.parseAddrSpec(); err == nil {
+		return address, nil
+	}
+	p.pos = start
+
+	name, err := p.parsePhrase()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume('<') {
+		return nil, p.errorf("expected an address in %q", p.s)
+	}
+	address, err := p.parseAddrSpec()
+	if err != nil {
+		return nil, err
+	}
+	if !p.consume('>') {
+		return nil, p.errorf("unclosed angle bracket in %q", p.s)
+	}
+	address.Name = name
+	return address, nil
+}
+
+var emailWordDecoder = new(mime.WordDecoder)
+
+// Parses a display name, decoding RFC 2047 encoded words
+func (p *emailAddressParser) parsePhrase() (string, error) {
+	var b strings.Builder
+	previousEncoded := false
+	for {
+		if err := p.skipCFWS(); err != nil {
+			return "", err
+		}
+		var word string
+		encoded := false
+		if p.peek() == '"' {
+			quoted, err := p.consumeQuotedString()
+			if err != nil {
+				return "", err
+			}
+			word = quoted
+		} else {
+			//Dots are common in names, even though RFC 5322 only allows them quoted
+			word = p.consumeAtom(true)
+			if word == "" {
+				return b.String(), nil
+			}
+			if decoded, err := emailWordDecoder.Decode(word); err == nil {
+				word, encoded = decoded, true
+			}
+		}
+		//Whitespace between encoded words is dropped
+		if b.Len() > 0 && !(encoded && previousEncoded) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(word)
+		previousEncoded = encoded
+	}
+}
+
+// Parses local@domain
+func (p *emailAddressParser) parseAddrSpec() (*EmailAddress, error) {
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+	address := new(EmailAddress)
+	if p.peek() == '"' {
+		local, err := p.consumeQuotedString()
+		if err != nil {
+			return nil, err
+		}
+		address.LocalPart = local
+	} else {
+		address.LocalPart = p.consumeAtom(true)
+		if !isDotAtom(address.LocalPart) {
+			return nil, p.errorf("invalid local part %q", address.LocalPart)
+		}
+	}
+	if address.LocalPart == "" {
+		return nil, p.errorf("empty local part")
+	}
+	if len(address.LocalPart) > maxLocalPartLength {
+		return nil, p.errorf("local part longer than %v", maxLocalPartLength)
+	}
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+	if !p.consume('@') {
+		return nil, p.errorf("missing @")
+	}
+	if err := p.skipCFWS(); err != nil {
+		return nil, err
+	}
+
+	if p.peek() == '[' {
+		end := strings.IndexByte(p.s[p.pos:], ']')
+		if end < 0 {
+			return nil, p.errorf("unclosed domain literal")
+		}
+		address.Domain = p.s[p.pos : p.pos+end+1]
+		p.pos += end + 1
+		if !isAddressLiteral(address.Domain) {
+			return nil, p.errorf("invalid domain literal %v", address.Domain)
+		}
+	} else {
+		address.Domain = p.consumeAtom(true)
+		ascii, err := asciiDomain(address.Domain)
+		if err != nil {
+			return nil, p.errorf("invalid domain %q - %v", address.Domain, err)
+		}
+		address.asciiDomain = ascii
+	}
+	if len(quoteLocalPart(address.LocalPart))+1+len(address.ASCIIDomain()) > maxEmailAddressLength {
+		return nil, p.errorf("address longer than %v", maxEmailAddressLength)
+	}
+	return address, nil
+}
+
+// Checks an address literal, [192.0.2.1] or [IPv6:2001:db8::1]
+func isAddressLiteral(literal string) bool {
+	literal = strings.TrimSuffix(strings.TrimPrefix(literal, "["), "]")
+	if v6, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+		ip := net.ParseIP(v6)
+		return ip != nil && ip.To4() == nil
+	}
+	ip := net.ParseIP(literal)
+	return ip != nil && ip.To4() != nil && !strings.Contains(literal, ":")
+}
+
+// Converts a host name to ASCII with IDNA, checking its labels
+func asciiDomain(domain string) (string, error) {
+	if !isDotAtom(domain) {
+		return "", errors.New("not a host name")
+	}
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", err
+	}
+	if len(ascii) > maxDomainLength {
+		return "", fmt.Errorf("longer than %v", maxDomainLength)
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return "", fmt.Errorf("invalid label %q", label)
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return "", fmt.Errorf("invalid label %q", label)
+			}
+		}
+	}
+	return ascii, nil
+}
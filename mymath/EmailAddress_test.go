@@ -0,0 +1,73 @@
+package mymath
+
+// Copyright 2016 ThePiachu. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseEmailAddress(t *testing.T) {
+	tests := []struct {
+		input, name, address, ascii, normalized string
+	}{
+		{"ann@example.com", "", "ann@example.com", "ann@example.com", "ann@example.com"},
+		{`"Ann Smith" <Ann.Smith@Example.COM>`, "Ann Smith", "Ann.Smith@Example.COM", "Ann.Smith@example.com", "ann.smith@example.com"},
+		{`Ann (work) <"ann smith"@example.com>`, "Ann", `"ann smith"@example.com`, `"ann smith"@example.com`, `"ann smith"@example.com`},
+		{`J. R. "Bob" Smith <bob+tag@example.com>`, "J. R. Bob Smith", "bob+tag@example.com", "bob+tag@example.com", "bob+tag@example.com"},
+		{"=?utf-8?q?Zo=C3=AB?= =?utf-8?q?_K?= <Zoë@Bücher.de>", "Zoë K", "Zoë@Bücher.de", "Zoë@xn--bcher-kva.de", "zoë@xn--bcher-kva.de"},
+		{`"a\"b"@example.com`, "", `"a\"b"@example.com`, `"a\"b"@example.com`, `"a\"b"@example.com`},
+		{`"ab"@example.com`, "", "ab@example.com", "ab@example.com", "ab@example.com"},
+		{"bob@[192.0.2.1]", "", "bob@[192.0.2.1]", "bob@[192.0.2.1]", "bob@[192.0.2.1]"},
+		{"bob@[IPv6:2001:db8::1]", "", "bob@[IPv6:2001:db8::1]", "bob@[IPv6:2001:db8::1]", "bob@[ipv6:2001:db8::1]"},
+		{" <bob@localhost> (comment) ", "", "bob@localhost", "bob@localhost", "bob@localhost"},
+	}
+	for _, test := range tests {
+		address, err := ParseEmailAddress(test.input)
+		if err != nil {
+			t.Errorf("ParseEmailAddress(%q) - %v", test.input, err)
+			continue
+		}
+		if address.Name != test.name || address.Address() != test.address ||
+			address.ASCIIAddress() != test.ascii || address.Normalized() != test.normalized {
+			t.Errorf("ParseEmailAddress(%q) - %q %q %q %q", test.input, address.Name, address.Address(), address.ASCIIAddress(), address.Normalized())
+		}
+	}
+
+	invalid := []string{
+		"", "ann", "@example.com", "ann@", "ann@@example.com", ".ann@example.com", "ann.@example.com",
+		"an..n@example.com", "ann@example..com", "ann@-example.com", "ann@exa_mple.com", "ann smith@example.com",
+		`"ann@example.com`, "Ann <ann@example.com", "ann@example.com>", "ann@[300.0.0.1]", "ann@[IPv6:192.0.2.1]",
+		"ann@example.com, bob@example.com", "ann@example.com (unclosed", "\"a\x00\"@example.com",
+		strings.Repeat("a", 65) + "@example.com", "ann@" + strings.Repeat("a", 64) + ".com",
+		"ann@" + strings.Repeat("abcdefghi.", 25) + "com",
+	}
+	for _, s := range invalid {
+		if _, err := ParseEmailAddress(s); !errors.Is(err, ErrInvalidEmailAddress) {
+			t.Errorf("ParseEmailAddress(%q) accepted - %v", s, err)
+		}
+	}
+
+	list, err := ParseEmailAddressList(`Ann <ann@example.com>, , "Smith, Bob" <bob@example.com>,carol@example.com`)
+	if err != nil || len(list) != 3 || list[1].Name != "Smith, Bob" || list[2].Address() != "carol@example.com" {
+		t.Errorf("ParseEmailAddressList - %v %v", list, err)
+	}
+	if list[1].String() != `"Smith, Bob" <bob@example.com>` {
+		t.Errorf("Invalid formatted address - %v", list[1])
+	}
+
+	for _, s := range []string{"ann@example.com", `"ann smith"@example.com`, "zoë@bücher.de"} {
+		if !IsStringAValidEmailAddress(s) {
+			t.Errorf("IsStringAValidEmailAddress rejected %q", s)
+		}
+	}
+	for _, s := range []string{"Ann <ann@example.com>", "ann@example.com,bob@example.com", " ann@example.com",
+		"ann@example.com ", "ann @ example.com", "ann(comment)@example.com", "ann@example.com (Ann)", "\"ann\r\n smith\"@example.com"} {
+		if IsStringAValidEmailAddress(s) {
+			t.Errorf("IsStringAValidEmailAddress accepted %q", s)
+		}
+	}
+}
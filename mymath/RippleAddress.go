@@ -13,14 +13,14 @@ var RippleAlphabet = "rpshnaf39wBUDNEGHJKLM4PQRST7VWXYZ2bcdeCg65jkm8oFqi1tuvAxyz
 
 type RippleAddress struct {
 	AccountID     string
-	MasterSeed    string
-	MasterSeedHex string
+	MasterSeed    string `log:"secret"`
+	MasterSeedHex string `log:"secret"`
 
-	PrivateGenerator   string
+	PrivateGenerator   string `log:"secret"`
 	PublicGenerator    string
 	PublicGeneratorHex string
 
-	PrivateKey   string
+	PrivateKey   string `log:"secret"`
 	PublicKey    string
 	PublicKeyHex string
 }
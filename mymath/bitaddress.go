@@ -237,8 +237,6 @@ type ecdsa struct {
 }
 
 func SignStringMessageWithPrivateKey(message string, key string) string {
-	log.Println("message - %X", message)
-	log.Println("key - %X", key)
 	privateKey := StringToPrivateKey(key)
 	dataToSign := ASCII2Hex(message)
 
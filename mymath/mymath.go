@@ -15,16 +15,14 @@ import (
 	"strings"
 )
 
+// Checks whether s is a bare address, local@domain, as described in EmailAddress.go.
+// Unlike ParseEmailAddress it doesn't skip surrounding whitespace or comments.
 func IsStringAValidEmailAddress(s string) bool {
-	//TODO: expand
-	if strings.Count(s, "@") != 1 {
+	p := &emailAddressParser{s: s, bare: true}
+	if _, err := p.parseAddrSpec(); err != nil {
 		return false
 	}
-	if strings.ContainsAny(s, " \"(),:;<>[]\\") {
-		return false
-	}
-
-	return true
+	return p.empty()
 }
 
 func DecodeJSON(data []byte, v interface{}) error {
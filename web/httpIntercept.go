@@ -1,11 +1,15 @@
 package web
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 	"runtime"
+	"strings"
 
 	"github.com/ThePiachu/Go/Log"
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 )
 
@@ -15,7 +19,12 @@ var Mux = http.NewServeMux()
 // Intercepts all requests before giving control to the Mux.
 // A panic() in the handler will be caught here where it will
 // be logged and a 500 response returned to the client.
+// Every request gets a request ID and trace ID stored in its context,
+// so all the lines logged while handling it can be correlated.
 func httpInterceptor(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(requestLogContext(r))
+	w.Header().Set("X-Request-Id", Log.RequestID(r.Context()))
+
 	defer func() {
 		if err := recover(); err != nil {
 			stackTrace := make([]byte, 1<<16)
@@ -33,6 +42,64 @@ func httpInterceptor(w http.ResponseWriter, r *http.Request) {
 	Mux.ServeHTTP(w, r)
 }
 
+// Stores the request ID, trace ID, method and path of the request in its context for the Log package
+func requestLogContext(r *http.Request) context.Context {
+	c := r.Context()
+	c = Log.WithRequestID(c, requestID(r))
+	if traceID := traceID(r); traceID != "" {
+		c = Log.WithTraceID(c, traceID)
+	}
+	return Log.WithFields(c, "method", r.Method, "path", r.URL.Path)
+}
+
+// Longest request ID accepted from the client
+const maxRequestIDLength = 128
+
+// Uses the ID given by the client or App Engine, or generates a new one.
+// Client IDs are echoed back and logged, so only short [A-Za-z0-9._-] ones are kept
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); isValidRequestID(id) {
+		return id
+	}
+	if id := r.Header.Get("X-Appengine-Request-Log-Id"); isValidRequestID(id) {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '.', ch == '_', ch == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the trace ID from the Cloud Trace or W3C Trace Context headers
+func traceID(r *http.Request) string {
+	if h := r.Header.Get("X-Cloud-Trace-Context"); h != "" {
+		if id := strings.SplitN(h, "/", 2)[0]; isValidRequestID(id) {
+			return id
+		}
+	}
+	if h := r.Header.Get("Traceparent"); h != "" {
+		parts := strings.Split(h, "-")
+		if len(parts) == 4 && isValidRequestID(parts[1]) {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
 func init() {
 	http.HandleFunc("/", httpInterceptor)
 }